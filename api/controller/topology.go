@@ -0,0 +1,49 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/iakinsey/delver/topology"
+	"github.com/iakinsey/delver/types/errs"
+	"github.com/iakinsey/delver/types/rpc"
+)
+
+type TopologyController interface {
+	Get(context.Context, json.RawMessage) (interface{}, error)
+}
+
+type topologyController struct{}
+
+func NewTopologyController() TopologyController {
+	return &topologyController{}
+}
+
+// Returns the running application graph with queue lengths and worker
+// counters, either as nodes and edges or rendered as DOT or Mermaid
+func (s *topologyController) Get(ctx context.Context, msg json.RawMessage) (interface{}, error) {
+	req := rpc.TopologyRequest{}
+
+	if len(msg) > 0 {
+		if err := json.Unmarshal(msg, &req); err != nil {
+			return nil, err
+		}
+	}
+
+	g, ok := topology.Live()
+
+	if !ok {
+		return nil, errs.NewRequestError("no application is running")
+	}
+
+	switch req.Format {
+	case "json", "":
+		return g, nil
+	case "dot":
+		return rpc.TopologyResponse{Format: req.Format, Source: g.DOT()}, nil
+	case "mermaid":
+		return rpc.TopologyResponse{Format: req.Format, Source: g.Mermaid()}, nil
+	default:
+		return nil, errs.NewRequestError("unknown topology format " + req.Format)
+	}
+}
@@ -74,6 +74,7 @@ func getRoutes(conf config.APIConfig, user gateway.UserGateway) map[string]Contr
 	routes := make(map[string]Controller)
 	dash := controller.NewDashboardController(gateway.NewDashboardGateway(conf.DashDBPath))
 	auth := controller.NewAuthController(user)
+	topology := controller.NewTopologyController()
 
 	routes["/dashboard/save"] = dash.Save
 	routes["/dashboard/load"] = dash.Load
@@ -84,6 +85,7 @@ func getRoutes(conf config.APIConfig, user gateway.UserGateway) map[string]Contr
 	routes["/user/authenticate"] = auth.Authenticate
 	routes["/user/change_password"] = auth.ChangePassword
 	routes["/user/logout"] = auth.Logout
+	routes["/topology"] = topology.Get
 
 	return routes
 }
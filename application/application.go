@@ -0,0 +1,302 @@
+package application
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/instrument"
+	"github.com/iakinsey/delver/queue"
+	"github.com/iakinsey/delver/resource"
+	"github.com/iakinsey/delver/topology"
+	"github.com/iakinsey/delver/worker"
+
+	// Built-in worker and resource types register themselves on import
+	_ "github.com/iakinsey/delver/resource/bloom"
+	_ "github.com/iakinsey/delver/resource/maps"
+	_ "github.com/iakinsey/delver/resource/objectstore"
+	_ "github.com/iakinsey/delver/worker/accumulator"
+	_ "github.com/iakinsey/delver/worker/extractor"
+	_ "github.com/iakinsey/delver/worker/fetcher"
+	_ "github.com/iakinsey/delver/worker/publisher"
+	_ "github.com/iakinsey/delver/worker/transformer"
+)
+
+// The resources and worker managers created from an application config
+type Application struct {
+	Config    config.Application
+	Resources map[string]interface{}
+	Workers   map[string]worker.WorkerManager
+	// Releases the locks held on file backed queues
+	unlocks []func() error
+}
+
+func New(conf config.Application) *Application {
+	return &Application{
+		Config:    conf,
+		Resources: make(map[string]interface{}),
+		Workers:   make(map[string]worker.WorkerManager),
+	}
+}
+
+// Validates, creates and starts an application
+func StartFromApplication(conf config.Application) (*Application, error) {
+	app := New(conf)
+
+	if err := app.Create(); err != nil {
+		return nil, err
+	}
+
+	topology.Publish(app.Config, app.Resources)
+
+	if err := app.Start(); err != nil {
+		return nil, err
+	}
+
+	return app, nil
+}
+
+// Validates the config and creates every resource and worker without
+// starting them
+func (s *Application) Create() error {
+	// Put the transformer queue at the start of the list, allowing
+	// other resources to access it in a stable manner
+	sort.SliceStable(s.Config.Resources, func(i, j int) bool {
+		return s.Config.Resources[i].Name == config.TransformerQueueName
+	})
+
+	if err := ValidateApplication(s.Config); err != nil {
+		return errors.Wrap(err, "invalid config")
+	}
+
+	for _, rc := range s.Config.Resources {
+		if err := s.CreateResource(rc); err != nil {
+			return err
+		}
+	}
+
+	for _, wc := range s.Config.Workers {
+		if err := s.CreateWorker(wc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Prepares and starts the queues, then the workers if they are enabled
+func (s *Application) Start() error {
+	for name, resource := range s.Resources {
+		if q, ok := resource.(queue.Queue); ok {
+			if err := q.Prepare(); err != nil {
+				return errors.Wrapf(err, "failed to prepare queue %s", name)
+			}
+
+			go q.Start()
+		}
+	}
+
+	if !s.Config.Config.Workers.Enabled {
+		return nil
+	}
+
+	for _, wc := range s.Config.Workers {
+		go s.Workers[wc.Name].Start()
+	}
+
+	return nil
+}
+
+// Shuts down in phases: workers stop taking messages and finish what they
+// have within the grace period, leftovers are returned to their inboxes,
+// workers flush their resources and finally the queues stop.
+func (s *Application) Terminate(grace time.Duration) {
+	var wg sync.WaitGroup
+
+	log.Infof("draining workers, grace period %s", grace)
+
+	for _, m := range s.Workers {
+		wg.Add(1)
+
+		go func(m worker.WorkerManager) {
+			defer wg.Done()
+			m.Drain(grace)
+		}(m)
+	}
+
+	wg.Wait()
+	log.Info("completing workers")
+
+	for _, m := range s.Workers {
+		wg.Add(1)
+
+		go func(m worker.WorkerManager) {
+			defer wg.Done()
+			m.Stop()
+		}(m)
+	}
+
+	wg.Wait()
+	log.Info("stopping queues")
+
+	for name, resource := range s.Resources {
+		if q, ok := resource.(queue.Queue); ok {
+			wg.Add(1)
+
+			go func(name string, q queue.Queue) {
+				defer wg.Done()
+
+				if err := q.Stop(); err != nil {
+					log.Errorf("failed to stop queue %s: %s", name, err)
+				}
+			}(name, q)
+		}
+	}
+
+	wg.Wait()
+
+	for _, unlock := range s.unlocks {
+		if err := unlock(); err != nil {
+			log.Errorf("failed to release queue lock: %s", err)
+		}
+	}
+}
+
+func (s *Application) CreateWorker(wc config.Worker) error {
+	factory, err := worker.GetFactory(wc.Type)
+
+	if err != nil {
+		return errors.Wrapf(err, "worker %s", wc.Name)
+	}
+
+	params := factory.Params()
+
+	if err := resource.Bind(wc.Parameters, params, s.Resources); err != nil {
+		return errors.Wrapf(err, "worker %s", wc.Name)
+	}
+
+	w := factory.New(params)
+
+	// Defaults to 0
+	if wc.Count == 0 && wc.Manager == "job" {
+		wc.Count = 1
+	} else if wc.Count == 0 {
+		wc.Count = s.Config.Config.Workers.WorkerCounts
+	}
+
+	m, err := GetWorkerManager(wc, s.Resources, w)
+
+	if err != nil {
+		return err
+	}
+
+	s.Workers[wc.Name] = m
+
+	return nil
+}
+
+func GetWorkerManager(wc config.Worker, resources map[string]interface{}, w worker.Worker) (worker.WorkerManager, error) {
+	inbox, ok := resources[wc.Inbox]
+
+	if !ok && wc.Manager != "job" {
+		return nil, errors.Errorf("worker %s has no inbox %s", wc.Name, wc.Inbox)
+	}
+
+	out, ok := resources[wc.Outbox]
+	var outbox queue.Queue = nil
+
+	if ok {
+		outbox = out.(queue.Queue)
+	}
+
+	var errorOutbox queue.Queue = nil
+
+	if wc.ErrorOutbox != "" {
+		errOut, ok := resources[wc.ErrorOutbox]
+
+		if !ok {
+			return nil, errors.Errorf("worker %s has no error outbox %s", wc.Name, wc.ErrorOutbox)
+		}
+
+		errorOutbox = errOut.(queue.Queue)
+	}
+
+	var routes []worker.Route
+
+	for _, rc := range wc.Routes {
+		routeOut, ok := resources[rc.Outbox]
+
+		if !ok {
+			return nil, errors.Errorf("worker %s has no route outbox %s", wc.Name, rc.Outbox)
+		}
+
+		route, err := worker.NewRoute(rc, routeOut.(queue.Queue))
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "worker %s has an invalid route", wc.Name)
+		}
+
+		routes = append(routes, route)
+	}
+
+	switch wc.Manager {
+	case "worker", "":
+		return worker.NewWorkerManager(worker.WorkerManagerParams{
+			Name:        wc.Name,
+			Worker:      w,
+			Inbox:       inbox.(queue.Queue),
+			Outbox:      outbox,
+			ErrorOutbox: errorOutbox,
+			Routes:      routes,
+			Config:      wc,
+		}), nil
+	case "job":
+		return worker.NewJobManager(
+			wc.Name,
+			w,
+			outbox,
+			routes,
+			queue.TimerQueueParams{
+				Delay:     wc.Interval,
+				Cron:      wc.Cron,
+				Jitter:    wc.Jitter,
+				StatePath: wc.StatePath,
+			},
+		), nil
+	default:
+		return nil, errors.Errorf("unknown worker manager: %s", wc.Manager)
+	}
+}
+
+// File backed queues are locked before they are created, failing if another
+// process is using them
+func (s *Application) CreateResource(rc config.Resource) error {
+	factory, params, err := resource.ParseResource(rc)
+
+	if err != nil {
+		return errors.Wrapf(err, "resource %s", rc.Name)
+	}
+
+	unlock, err := queue.Lock(rc)
+
+	if err != nil {
+		return errors.Wrapf(err, "resource %s", rc.Name)
+	}
+
+	s.unlocks = append(s.unlocks, unlock)
+
+	r := factory.New(params)
+
+	// Set metrics value if resoruce is specified
+	if rc.Name == config.TransformerQueueName {
+		instrument.SetMetrics(r.(queue.Queue))
+	}
+
+	s.Resources[rc.Name] = r
+
+	return nil
+}
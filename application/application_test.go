@@ -0,0 +1,24 @@
+package application
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iakinsey/delver/config"
+)
+
+func TestCreateInvalidApplication(t *testing.T) {
+	conf := newTestApplication()
+	conf.Workers = append(conf.Workers, config.Worker{Name: "unknown", Type: "unknown"})
+	app := New(conf)
+
+	assert.Error(t, app.Create())
+	assert.Empty(t, app.Resources)
+}
+
+func TestGetWorkerManagerMissingInbox(t *testing.T) {
+	_, err := GetWorkerManager(config.Worker{Name: "fetcher", Inbox: "missing"}, map[string]interface{}{}, nil)
+
+	assert.EqualError(t, err, "worker fetcher has no inbox missing")
+}
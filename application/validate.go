@@ -0,0 +1,392 @@
+package application
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/queue"
+	"github.com/iakinsey/delver/resource"
+	"github.com/iakinsey/delver/types"
+	"github.com/iakinsey/delver/worker"
+)
+
+var queueType = reflect.TypeOf((*queue.Queue)(nil)).Elem()
+
+// What validation learns about a worker while checking its own config
+type validatedWorker struct {
+	conf    config.Worker
+	factory worker.Factory
+	// Message types published to each queue, by queue name
+	sends map[string][]types.MessageType
+	// Queues written to through resource parameters rather than outboxes
+	writes []string
+}
+
+type topologyValidator struct {
+	app       config.Application
+	resources map[string]resource.Factory
+	workers   []*validatedWorker
+	result    error
+}
+
+// Checks the whole application before anything is created: every worker and
+// resource type is registered and its parameters parse, every referenced
+// inbox, outbox and resource exists with the right type, consumers accept
+// the message types sent to them, workers that publish have somewhere to
+// publish to and no cycle of queues lacks a way out. All problems are
+// reported together.
+func ValidateApplication(app config.Application) error {
+	v := &topologyValidator{
+		app:       app,
+		resources: make(map[string]resource.Factory),
+	}
+
+	v.validateResources()
+	v.validateWorkers()
+	v.validateMessageTypes()
+	v.validateCycles()
+
+	return v.result
+}
+
+func (s *topologyValidator) fail(format string, args ...interface{}) {
+	s.result = multierror.Append(s.result, fmt.Errorf(format, args...))
+}
+
+func (s *topologyValidator) validateResources() {
+	for _, rc := range s.app.Resources {
+		if _, ok := s.resources[rc.Name]; ok {
+			s.fail("resource %s is defined twice", rc.Name)
+			continue
+		}
+
+		factory, _, err := resource.ParseResource(rc)
+
+		if err != nil {
+			s.fail("resource %s: %s", rc.Name, err)
+		}
+
+		s.resources[rc.Name] = factory
+	}
+}
+
+func (s *topologyValidator) validateWorkers() {
+	names := make(map[string]bool)
+
+	for _, wc := range s.app.Workers {
+		if names[wc.Name] {
+			s.fail("worker %s is defined twice", wc.Name)
+			continue
+		}
+
+		names[wc.Name] = true
+		factory, err := worker.GetFactory(wc.Type)
+
+		if err != nil {
+			s.fail("worker %s: %s", wc.Name, err)
+			continue
+		}
+
+		w := &validatedWorker{
+			conf:    wc,
+			factory: factory,
+			sends:   make(map[string][]types.MessageType),
+		}
+
+		s.validateQueues(w)
+		s.validateOutboxes(w)
+		s.validateParams(w)
+		s.workers = append(s.workers, w)
+	}
+}
+
+func (s *topologyValidator) failWorker(w *validatedWorker, format string, args ...interface{}) {
+	s.fail("worker %s: %s", w.conf.Name, fmt.Sprintf(format, args...))
+}
+
+func (s *topologyValidator) validateQueues(w *validatedWorker) {
+	switch w.conf.Manager {
+	case "worker", "":
+		if w.conf.Inbox == "" {
+			s.failWorker(w, "has no inbox")
+		} else if err := s.checkResource(w.conf.Inbox, queueType); err != nil {
+			s.failWorker(w, "inbox %s", err)
+		}
+	case "job":
+	default:
+		s.failWorker(w, "unknown worker manager %s", w.conf.Manager)
+	}
+
+	if w.conf.ErrorOutbox != "" {
+		if err := s.checkResource(w.conf.ErrorOutbox, queueType); err != nil {
+			s.failWorker(w, "error outbox %s", err)
+		}
+	}
+}
+
+// Works out which message types reach the outbox and each route. A route
+// with a match expression may not take every message of its type, so the
+// outbox is assumed to receive them as well.
+func (s *topologyValidator) validateOutboxes(w *validatedWorker) {
+	unclaimed := make(map[types.MessageType]bool)
+
+	for _, t := range w.factory.Emits {
+		unclaimed[t] = true
+	}
+
+	for _, rc := range w.conf.Routes {
+		route, err := worker.NewRoute(rc, nil)
+
+		if err != nil {
+			s.failWorker(w, "invalid route: %s", err)
+			continue
+		} else if err := s.checkResource(rc.Outbox, queueType); err != nil {
+			s.failWorker(w, "route outbox %s", err)
+			continue
+		}
+
+		for _, t := range w.factory.Emits {
+			if !route.MatchesType(t) {
+				continue
+			}
+
+			w.sends[rc.Outbox] = append(w.sends[rc.Outbox], t)
+
+			if rc.Match == "" {
+				delete(unclaimed, t)
+			}
+		}
+	}
+
+	var missing []string
+
+	for _, t := range w.factory.Emits {
+		if !unclaimed[t] {
+			continue
+		} else if w.conf.Outbox != "" {
+			w.sends[w.conf.Outbox] = append(w.sends[w.conf.Outbox], t)
+		} else {
+			missing = append(missing, t.String())
+		}
+	}
+
+	if w.conf.Outbox != "" {
+		if err := s.checkResource(w.conf.Outbox, queueType); err != nil {
+			s.failWorker(w, "outbox %s", err)
+			delete(w.sends, w.conf.Outbox)
+		}
+	} else if len(missing) > 0 {
+		s.failWorker(w, "publishes %s but has no outbox for it", strings.Join(missing, ", "))
+	}
+}
+
+func (s *topologyValidator) validateParams(w *validatedWorker) {
+	params := w.factory.Params()
+
+	if err := resource.ParseParams(w.conf.Parameters, params); err != nil {
+		s.failWorker(w, "%s", err)
+		return
+	}
+
+	refs, err := resource.References(w.conf.Parameters, params)
+
+	if err != nil {
+		s.failWorker(w, "%s", err)
+		return
+	}
+
+	elem := reflect.TypeOf(params).Elem()
+
+	for i := 0; i < elem.NumField(); i++ {
+		field := elem.Field(i)
+		tag, _ := resource.Tag(field)
+		name, ok := refs[tag]
+
+		if !ok {
+			continue
+		}
+
+		if err := s.checkResource(name, field.Type); err != nil {
+			s.failWorker(w, "parameter %s: %s", tag, err)
+		} else if field.Type.Implements(queueType) {
+			w.writes = append(w.writes, name)
+		}
+	}
+}
+
+// Resources without a registered type can not be checked further
+func (s *topologyValidator) checkResource(name string, want reflect.Type) error {
+	factory, ok := s.resources[name]
+
+	if !ok {
+		return fmt.Errorf("resource %s is not defined", name)
+	} else if factory.Type != nil && !factory.Type.AssignableTo(want) {
+		return fmt.Errorf("resource %s is a %s, not a %s", name, factory.Type, want)
+	}
+
+	return nil
+}
+
+func (s *topologyValidator) validateMessageTypes() {
+	for _, producer := range s.workers {
+		for _, name := range sortedQueues(producer.sends) {
+			for _, consumer := range s.workers {
+				if consumer.conf.Inbox != name || consumer.conf.Manager == "job" || len(consumer.factory.Accepts) == 0 {
+					continue
+				}
+
+				for _, t := range producer.sends[name] {
+					if !containsMessageType(consumer.factory.Accepts, t) {
+						s.fail(
+							"worker %s publishes %s to %s, which worker %s does not accept",
+							producer.conf.Name, t, name, consumer.conf.Name,
+						)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Messages flow from queues to the workers reading them and from workers to
+// the queues they publish or write to. A cycle is fine as long as something
+// leaves it, otherwise messages can only circulate.
+func (s *topologyValidator) validateCycles() {
+	graph := make(map[string][]string)
+
+	for _, w := range s.workers {
+		node := "worker " + w.conf.Name
+
+		if w.conf.Manager != "job" && w.conf.Inbox != "" {
+			graph["queue "+w.conf.Inbox] = append(graph["queue "+w.conf.Inbox], node)
+		}
+
+		for _, name := range sortedQueues(w.sends) {
+			graph[node] = append(graph[node], "queue "+name)
+		}
+
+		for _, name := range w.writes {
+			graph[node] = append(graph[node], "queue "+name)
+		}
+
+		if len(w.factory.Emits) == 0 && len(w.writes) == 0 {
+			graph[node] = append(graph[node], "sink")
+		}
+	}
+
+	for _, component := range stronglyConnected(graph) {
+		members := make(map[string]bool)
+
+		for _, node := range component {
+			members[node] = true
+		}
+
+		cyclic, exits := len(component) > 1, false
+
+		for _, node := range component {
+			for _, next := range graph[node] {
+				if !members[next] {
+					exits = true
+				} else if next == node {
+					cyclic = true
+				}
+			}
+		}
+
+		if cyclic && !exits {
+			sort.Strings(component)
+			s.fail("cycle without a sink: %s", strings.Join(component, ", "))
+		}
+	}
+}
+
+// Tarjan's algorithm, visiting nodes in sorted order for stable output
+func stronglyConnected(graph map[string][]string) (components [][]string) {
+	index := make(map[string]int)
+	low := make(map[string]int)
+	onStack := make(map[string]bool)
+	var stack []string
+
+	var visit func(node string)
+
+	visit = func(node string) {
+		index[node] = len(index)
+		low[node] = index[node]
+		stack = append(stack, node)
+		onStack[node] = true
+
+		for _, next := range graph[node] {
+			if _, seen := index[next]; !seen {
+				visit(next)
+
+				if low[next] < low[node] {
+					low[node] = low[next]
+				}
+			} else if onStack[next] && index[next] < low[node] {
+				low[node] = index[next]
+			}
+		}
+
+		if low[node] != index[node] {
+			return
+		}
+
+		var component []string
+
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			component = append(component, top)
+
+			if top == node {
+				break
+			}
+		}
+
+		components = append(components, component)
+	}
+
+	var nodes []string
+
+	for node := range graph {
+		nodes = append(nodes, node)
+	}
+
+	sort.Strings(nodes)
+
+	for _, node := range nodes {
+		if _, seen := index[node]; !seen {
+			visit(node)
+		}
+	}
+
+	return
+}
+
+func sortedQueues(sends map[string][]types.MessageType) []string {
+	var names []string
+
+	for name := range sends {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func containsMessageType(list []types.MessageType, t types.MessageType) bool {
+	for _, item := range list {
+		if item == t {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,106 @@
+package application
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iakinsey/delver/config"
+)
+
+func newTestApplication() config.Application {
+	return config.Application{
+		Resources: []config.Resource{
+			{Name: "fetch_in", Type: "channel_queue"},
+			{Name: "extract_in", Type: "channel_queue"},
+			{Name: "accumulate_in", Type: "channel_queue"},
+			{Name: config.TransformerQueueName, Type: "channel_queue"},
+			{Name: "store", Type: "filesystem_object_store"},
+			{Name: "urls", Type: "persistent_map"},
+			{Name: "visited", Type: "bloom_filter"},
+		},
+		Workers: []config.Worker{
+			{
+				Name:       "fetcher",
+				Type:       "http_fetcher",
+				Inbox:      "fetch_in",
+				Outbox:     "extract_in",
+				Parameters: json.RawMessage(`{"object_store": "store"}`),
+			},
+			{
+				Name:       "extractor",
+				Type:       "composite_extractor",
+				Inbox:      "extract_in",
+				Outbox:     "accumulate_in",
+				Parameters: json.RawMessage(`{"object_store": "store"}`),
+			},
+			{
+				Name:       "accumulator",
+				Type:       "dfs_basic_accumulator",
+				Inbox:      "accumulate_in",
+				Outbox:     "fetch_in",
+				Parameters: json.RawMessage(`{"url_store": "urls", "visited_urls": "visited"}`),
+			},
+			{
+				Name:  "transformer",
+				Type:  "transformer",
+				Inbox: config.TransformerQueueName,
+			},
+		},
+	}
+}
+
+func assertValidationErrors(t *testing.T, app config.Application, expected ...string) {
+	err := ValidateApplication(app)
+
+	if len(expected) == 0 {
+		assert.NoError(t, err)
+		return
+	}
+
+	var actual []string
+
+	if merr, ok := err.(*multierror.Error); assert.True(t, ok) {
+		for _, e := range merr.Errors {
+			actual = append(actual, e.Error())
+		}
+	}
+
+	assert.Equal(t, expected, actual)
+}
+
+func TestValidateApplication(t *testing.T) {
+	assertValidationErrors(t, newTestApplication())
+}
+
+func TestValidateApplicationReferences(t *testing.T) {
+	app := newTestApplication()
+	app.Workers[0].Outbox = ""
+	app.Workers[1].Inbox = "missing"
+	app.Workers[2].Parameters = json.RawMessage(`{"url_store": "visited", "visited_urls": "visited"}`)
+	app.Workers = append(app.Workers, config.Worker{Name: "unknown", Type: "unknown"})
+
+	assertValidationErrors(
+		t,
+		app,
+		"worker fetcher: publishes fetcher_response but has no outbox for it",
+		"worker extractor: inbox resource missing is not defined",
+		"worker accumulator: parameter url_store: resource visited is a bloom.BloomFilter, not a maps.Map",
+		"worker unknown: unknown worker type unknown",
+	)
+}
+
+func TestValidateApplicationTopology(t *testing.T) {
+	app := newTestApplication()
+	app.Workers[1].Outbox = "fetch_in"
+	app.Workers[1].Parameters = json.RawMessage(`{"object_store": "store", "transformer_queue": "extract_in"}`)
+
+	assertValidationErrors(
+		t,
+		app,
+		"worker extractor publishes composite_analysis to fetch_in, which worker fetcher does not accept",
+		"cycle without a sink: queue extract_in, queue fetch_in, worker extractor, worker fetcher",
+	)
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iakinsey/delver/application"
+	"github.com/iakinsey/delver/codec"
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/queue"
+	"github.com/iakinsey/delver/types"
+)
+
+// Stop moving once the source has produced nothing for this long
+const moveIdleTimeout = 2 * time.Second
+
+var queueResourceTypes = map[string]bool{
+	"file_queue":         true,
+	"indexed_file_queue": true,
+	"channel_queue":      true,
+	"amqp_queue":         true,
+}
+
+const queueUsage = `usage: delver queue <command> [flags] <config> [queues]
+
+commands:
+  list <config>                          print every queue and its length
+  peek [-n count] <config> <queue>       print pending messages without claiming them
+  purge <config> <queue>                 discard every pending message
+  move [-n count] [-p priority] [-dlq] <config> <from> <to>
+                                         transfer messages between queues, or the
+                                         dead letters of <from> with -dlq
+  requeue <config> <queue>               return dead lettered messages to the queue
+  export [-o path] <config> <queue>      write pending messages as JSON lines
+
+list, peek and export can run alongside the application. purge, move and
+requeue need it stopped and refuse to run while it holds file backed queues.`
+
+// Commands either inspect queues, which are opened read only where the queue
+// type allows, or run against the named queues created as on startup, without
+// preparing them, so claims are left alone
+type queueCommand struct {
+	args    int
+	flags   func(*flag.FlagSet)
+	inspect func(config.Application, []string)
+	run     func(map[string]queue.Queue, []string)
+}
+
+type peekedMessage struct {
+	ID          string          `json:"id"`
+	MessageType string          `json:"message_type"`
+	Attempts    int             `json:"attempts,omitempty"`
+	Headers     types.Headers   `json:"headers"`
+	Message     interface{}     `json:"message"`
+	Raw         json.RawMessage `json:"raw,omitempty"`
+}
+
+// Administers the queues of an application config without starting workers
+func RunQueueCommand(args []string) {
+	var limit, priority int
+	var output string
+	var fromDLQ bool
+
+	commands := map[string]queueCommand{
+		"list": {args: 0, inspect: listQueues},
+		"peek": {args: 1, flags: func(f *flag.FlagSet) {
+			f.IntVar(&limit, "n", 10, "number of messages, 0 for all")
+		}, inspect: func(app config.Application, names []string) {
+			peekQueue(app, names, limit)
+		}},
+		"purge": {args: 1, run: purgeQueue},
+		"move": {args: 2, flags: func(f *flag.FlagSet) {
+			f.IntVar(&limit, "n", 0, "number of messages, 0 for all")
+			f.IntVar(&priority, "p", 0, "priority to enqueue with")
+			f.BoolVar(&fromDLQ, "dlq", false, "move dead letters of the source queue")
+		}, run: func(queues map[string]queue.Queue, names []string) {
+			if fromDLQ {
+				moveDeadLetters(queues, names, limit, priority)
+			} else {
+				moveMessages(queues, names, limit, priority)
+			}
+		}},
+		"requeue": {args: 1, run: requeueDeadLetters},
+		"export": {args: 1, flags: func(f *flag.FlagSet) {
+			f.StringVar(&output, "o", "", "output path, defaults to stdout")
+		}, inspect: func(app config.Application, names []string) {
+			exportQueue(app, names, output)
+		}},
+	}
+
+	if len(args) == 0 {
+		exitWithQueueUsage()
+	}
+
+	command, ok := commands[args[0]]
+
+	if !ok {
+		exitWithQueueUsage()
+	}
+
+	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
+	flags.Usage = exitWithQueueUsage
+
+	if command.flags != nil {
+		command.flags(flags)
+	}
+
+	flags.Parse(args[1:])
+
+	if flags.NArg() != command.args+1 {
+		exitWithQueueUsage()
+	}
+
+	if command.inspect != nil {
+		app := LoadJsonConfig(flags.Arg(0))
+
+		for _, name := range flags.Args()[1:] {
+			if _, ok := getQueueConfig(app, name); !ok {
+				log.Fatalf("no queue named %s", name)
+			}
+		}
+
+		command.inspect(app, flags.Args()[1:])
+
+		return
+	}
+
+	command.run(LoadQueues(flags.Arg(0), flags.Args()[1:]), flags.Args()[1:])
+}
+
+func exitWithQueueUsage() {
+	fmt.Fprintln(os.Stderr, queueUsage)
+	os.Exit(2)
+}
+
+// Creates the named queues of an application config, locking file backed
+// queues so the command does not run alongside the application
+func LoadQueues(path string, names []string) map[string]queue.Queue {
+	conf := LoadJsonConfig(path)
+	app := application.New(conf)
+
+	for _, name := range names {
+		rc, ok := getQueueConfig(conf, name)
+
+		if !ok {
+			log.Fatalf("no queue named %s", name)
+		}
+
+		if _, ok := app.Resources[name]; ok {
+			continue
+		}
+
+		if err := app.CreateResource(rc); err != nil {
+			log.Fatalf("failed to create queue: %s", err)
+		}
+	}
+
+	queues := make(map[string]queue.Queue)
+
+	for name, resource := range app.Resources {
+		queues[name] = resource.(queue.Queue)
+	}
+
+	return queues
+}
+
+func getQueueConfig(app config.Application, name string) (config.Resource, bool) {
+	for _, rc := range app.Resources {
+		if rc.Name == name && queueResourceTypes[rc.Type] {
+			return rc, true
+		}
+	}
+
+	return config.Resource{}, false
+}
+
+// Queues without a read only view are created, but not prepared
+func listQueues(app config.Application, _ []string) {
+	lengths := make(map[string]int64)
+	var names []string
+
+	for _, rc := range app.Resources {
+		if !queueResourceTypes[rc.Type] {
+			continue
+		}
+
+		if reader, err := queue.OpenReader(rc); err == nil {
+			lengths[rc.Name] = reader.Len()
+		} else if errors.Is(err, queue.ErrNoReader) {
+			a := application.New(app)
+
+			if err := a.CreateResource(rc); err != nil {
+				log.Errorf("failed to create queue: %s", err)
+				continue
+			}
+
+			lengths[rc.Name] = a.Resources[rc.Name].(queue.Queue).Len()
+		} else {
+			log.Errorf("failed to open queue %s: %s", rc.Name, err)
+			continue
+		}
+
+		names = append(names, rc.Name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Printf("%s\t%d\n", name, lengths[name])
+	}
+}
+
+func peekQueue(app config.Application, names []string, limit int) {
+	messages := getPendingMessages(app, names[0], limit)
+
+	for _, msg := range messages {
+		peeked := peekedMessage{
+			ID:          msg.ID,
+			MessageType: msg.MessageType.String(),
+			Attempts:    msg.Attempts,
+			Headers:     msg.Headers,
+		}
+
+		if decoded, err := types.DecodeMessage(msg); err == nil {
+			peeked.Message = decoded
+		} else if raw, err := codec.ToJSON(msg.Message); err != nil {
+			log.Errorf("failed to decode message %s: %s", msg.ID, err)
+		} else {
+			peeked.Raw = raw
+		}
+
+		b, err := json.MarshalIndent(peeked, "", "  ")
+
+		if err != nil {
+			log.Fatalf("failed to serialize message %s: %s", msg.ID, err)
+		}
+
+		fmt.Println(string(b))
+	}
+}
+
+func purgeQueue(queues map[string]queue.Queue, names []string) {
+	purgeable, ok := queues[names[0]].(queue.PurgeableQueue)
+
+	if !ok {
+		log.Fatalf("queue %s does not support purging", names[0])
+	}
+
+	count, err := purgeable.Purge()
+
+	if err != nil {
+		log.Fatalf("failed to purge queue %s after %d messages: %s", names[0], count, err)
+	}
+
+	fmt.Printf("purged %d messages from %s\n", count, names[0])
+}
+
+// Messages are claimed from the source and only acknowledged once the
+// destination has accepted them
+func moveMessages(queues map[string]queue.Queue, names []string, limit int, priority int) {
+	from, to := queues[names[0]], queues[names[1]]
+	count := 0
+
+	if err := from.Start(); err != nil {
+		log.Fatalf("failed to start queue %s: %s", names[0], err)
+	}
+
+	defer from.Stop()
+
+	for limit <= 0 || count < limit {
+		var msg types.Message
+
+		select {
+		case msg = <-from.GetChannel():
+		case <-time.After(moveIdleTimeout):
+			fmt.Printf("moved %d messages from %s to %s\n", count, names[0], names[1])
+			return
+		}
+
+		if err := to.Put(msg, priority); err != nil {
+			from.EndTransaction(msg, false)
+			log.Errorf("failed to move message %s after %d messages: %s", msg.ID, count, err)
+			return
+		}
+
+		if err := from.EndTransaction(msg, true); err != nil {
+			log.Errorf("message %s was copied but not removed from %s: %s", msg.ID, names[0], err)
+		}
+
+		count += 1
+	}
+
+	fmt.Printf("moved %d messages from %s to %s\n", count, names[0], names[1])
+}
+
+func moveDeadLetters(queues map[string]queue.Queue, names []string, limit int, priority int) {
+	dlq, ok := queues[names[0]].(queue.DeadLetterQueue)
+
+	if !ok {
+		log.Fatalf("queue %s has no dead letter queue", names[0])
+	}
+
+	count, err := dlq.MoveDeadLetters(queues[names[1]], priority, limit)
+
+	if err != nil {
+		log.Fatalf("failed to move dead letters of %s after %d messages: %s", names[0], count, err)
+	}
+
+	fmt.Printf("moved %d dead letters from %s to %s\n", count, names[0], names[1])
+}
+
+func requeueDeadLetters(queues map[string]queue.Queue, names []string) {
+	dlq, ok := queues[names[0]].(queue.DeadLetterQueue)
+
+	if !ok {
+		log.Fatalf("queue %s has no dead letter queue", names[0])
+	}
+
+	count, err := dlq.RequeueDeadLetters()
+
+	if err != nil {
+		log.Fatalf("failed to requeue dead letters for %s after %d messages: %s", names[0], count, err)
+	}
+
+	fmt.Printf("requeued %d messages into %s\n", count, names[0])
+}
+
+func exportQueue(app config.Application, names []string, output string) {
+	var w io.Writer = os.Stdout
+
+	if output != "" {
+		f, err := os.Create(output)
+
+		if err != nil {
+			log.Fatalf("failed to create export file %s: %s", output, err)
+		}
+
+		defer f.Close()
+		w = f
+	}
+
+	buf := bufio.NewWriter(w)
+	defer buf.Flush()
+
+	encoder := json.NewEncoder(buf)
+
+	for _, msg := range getPendingMessages(app, names[0], 0) {
+		payload, err := exportPayload(msg)
+
+		if err != nil {
+			log.Fatalf("failed to decode message %s: %s", msg.ID, err)
+		}
+
+		msg.Message = payload
+
+		if err := encoder.Encode(msg); err != nil {
+			log.Fatalf("failed to export message %s: %s", msg.ID, err)
+		}
+	}
+}
+
+// Payloads written by any codec are decoded into their registered type and
+// re-encoded as JSON, payloads of unregistered types are converted as is
+func exportPayload(msg types.Message) (types.Payload, error) {
+	value, err := types.DecodeMessage(msg)
+
+	if err != nil {
+		raw, err := codec.ToJSON(msg.Message)
+
+		return types.Payload(raw), err
+	}
+
+	b, err := json.Marshal(value)
+
+	return types.Payload(b), err
+}
+
+func getPendingMessages(app config.Application, name string, limit int) []types.Message {
+	rc, _ := getQueueConfig(app, name)
+	reader, err := queue.OpenReader(rc)
+
+	if errors.Is(err, queue.ErrNoReader) {
+		log.Fatalf("queue %s does not support reading without consuming", name)
+	} else if err != nil {
+		log.Fatalf("failed to open queue %s: %s", name, err)
+	}
+
+	messages, err := reader.Peek(limit)
+
+	if err != nil {
+		log.Fatalf("failed to read queue %s: %s", name, err)
+	}
+
+	return messages
+}
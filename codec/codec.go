@@ -0,0 +1,194 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/iakinsey/delver/config"
+)
+
+// Encoded data starts with a version byte naming the format followed by a
+// byte naming the compression. Plain uncompressed JSON is written without a
+// header so it stays readable, and data whose first byte is not a known
+// version is decoded as JSON. This lets queues holding messages written
+// under different codec configs still decode.
+const (
+	versionJSON    byte = 1
+	versionMsgpack byte = 2
+	headerSize          = 2
+)
+
+// Serializes values without framing or compression
+type Format interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var formats = map[byte]Format{
+	versionJSON:    jsonFormat{},
+	versionMsgpack: msgpackFormat{},
+}
+
+var formatVersions = map[string]byte{
+	"":        versionJSON,
+	"json":    versionJSON,
+	"msgpack": versionMsgpack,
+}
+
+type Codec struct {
+	version     byte
+	compression byte
+}
+
+func New(conf config.CodecConfig) (Codec, error) {
+	version, ok := formatVersions[conf.Format]
+
+	if !ok {
+		return Codec{}, fmt.Errorf("unknown codec format %q", conf.Format)
+	}
+
+	compression, ok := compressionIDs[conf.Compression]
+
+	if !ok {
+		return Codec{}, fmt.Errorf("unknown codec compression %q", conf.Compression)
+	}
+
+	return Codec{version: version, compression: compression}, nil
+}
+
+// Returns the codec set in the application config
+func Get() Codec {
+	c, err := New(config.Get().Codec)
+
+	if err != nil {
+		log.Fatalf("invalid codec config: %s", err)
+	}
+
+	return c
+}
+
+// Encodes a queued message with the configured codec
+func Marshal(v interface{}) ([]byte, error) {
+	return Get().Marshal(v)
+}
+
+// Encodes a message payload with the configured codec
+func MarshalPayload(v interface{}) ([]byte, error) {
+	return Get().MarshalPayload(v)
+}
+
+func (s Codec) Marshal(v interface{}) ([]byte, error) {
+	data, err := formats[s.version].Marshal(v)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode value")
+	}
+
+	if s.version == versionJSON && s.compression == compressionNone {
+		return data, nil
+	}
+
+	if s.compression != compressionNone {
+		if data, err = compressors[s.compression].compress(data); err != nil {
+			return nil, errors.Wrap(err, "failed to compress value")
+		}
+	}
+
+	return append([]byte{s.version, s.compression}, data...), nil
+}
+
+// Payloads are not compressed on their own since the message holding them is
+func (s Codec) MarshalPayload(v interface{}) ([]byte, error) {
+	s.compression = compressionNone
+
+	return s.Marshal(v)
+}
+
+// Only plain JSON is readable without this package
+func (s Codec) ContentType() string {
+	if s.version == versionJSON && s.compression == compressionNone {
+		return "application/json"
+	}
+
+	return "application/octet-stream"
+}
+
+// Decodes data written by any codec
+func Unmarshal(data []byte, v interface{}) error {
+	if len(data) < headerSize || formats[data[0]] == nil {
+		return json.Unmarshal(data, v)
+	}
+
+	version, compression, data := data[0], data[1], data[headerSize:]
+
+	if compression != compressionNone {
+		c, ok := compressors[compression]
+
+		if !ok {
+			return fmt.Errorf("unknown compression id %d", compression)
+		}
+
+		var err error
+
+		if data, err = c.decompress(data); err != nil {
+			return errors.Wrap(err, "failed to decompress value")
+		}
+	}
+
+	return formats[version].Unmarshal(data, v)
+}
+
+// Re-encodes data written by any codec as plain JSON, for display
+func ToJSON(data []byte) (json.RawMessage, error) {
+	if len(data) < headerSize || formats[data[0]] == nil {
+		return json.RawMessage(data), nil
+	}
+
+	var value interface{}
+
+	if err := Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(value)
+
+	return json.RawMessage(b), err
+}
+
+type jsonFormat struct{}
+
+func (jsonFormat) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonFormat) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Uses the json struct tags so message types need no extra annotations
+type msgpackFormat struct{}
+
+func (msgpackFormat) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (msgpackFormat) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+
+	return dec.Decode(v)
+}
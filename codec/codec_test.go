@@ -0,0 +1,95 @@
+package codec
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iakinsey/delver/config"
+)
+
+type testRequest struct {
+	URI   string `json:"uri,omitempty"`
+	Host  string `json:"host,omitempty"`
+	Depth int    `json:"depth,omitempty"`
+}
+
+// Mirrors the layout of types.Message, which imports this package
+type testMessage struct {
+	ID      string            `json:"id"`
+	Message json.RawMessage   `json:"message"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	request := testRequest{URI: "http://example.com", Host: "example.com", Depth: 2}
+
+	for _, format := range []string{"json", "msgpack"} {
+		for _, compression := range []string{"none", "snappy", "zstd"} {
+			c, err := New(config.CodecConfig{Format: format, Compression: compression})
+
+			assert.NoError(t, err)
+
+			payload, err := c.MarshalPayload(request)
+
+			assert.NoError(t, err)
+
+			msg := testMessage{
+				ID:      "id",
+				Message: json.RawMessage(payload),
+				Headers: map[string]string{"trace": "id"},
+			}
+			b, err := c.Marshal(msg)
+
+			assert.NoError(t, err)
+
+			decodedMsg := testMessage{}
+			decodedRequest := testRequest{}
+
+			assert.NoError(t, Unmarshal(b, &decodedMsg), "%s/%s", format, compression)
+			assert.NoError(t, Unmarshal(decodedMsg.Message, &decodedRequest))
+			assert.Equal(t, msg.Headers, decodedMsg.Headers)
+			assert.Equal(t, request, decodedRequest)
+		}
+	}
+}
+
+func TestCodecPlainJSON(t *testing.T) {
+	c, err := New(config.CodecConfig{Format: "json", Compression: "none"})
+
+	assert.NoError(t, err)
+
+	b, err := c.Marshal(map[string]int{"a": 1})
+
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":1}`, string(b))
+	assert.Equal(t, "application/json", c.ContentType())
+}
+
+func TestCodecToJSON(t *testing.T) {
+	c, err := New(config.CodecConfig{Format: "msgpack", Compression: "snappy"})
+
+	assert.NoError(t, err)
+
+	b, err := c.Marshal(testRequest{URI: "http://example.com"})
+
+	assert.NoError(t, err)
+
+	raw, err := ToJSON(b)
+	document := map[string]interface{}{}
+
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(raw, &document))
+	assert.Equal(t, "http://example.com", document["uri"])
+}
+
+func TestCodecInvalidConfig(t *testing.T) {
+	_, err := New(config.CodecConfig{Format: "xml"})
+
+	assert.Error(t, err)
+
+	_, err = New(config.CodecConfig{Format: "json", Compression: "lzma"})
+
+	assert.Error(t, err)
+}
@@ -0,0 +1,78 @@
+package codec
+
+import (
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressionNone   byte = 0
+	compressionSnappy byte = 1
+	compressionZstd   byte = 2
+)
+
+type compressor interface {
+	compress([]byte) ([]byte, error)
+	decompress([]byte) ([]byte, error)
+}
+
+var compressors = map[byte]compressor{
+	compressionSnappy: snappyCompressor{},
+	compressionZstd:   &zstdCompressor{},
+}
+
+var compressionIDs = map[string]byte{
+	"":       compressionNone,
+	"none":   compressionNone,
+	"snappy": compressionSnappy,
+	"zstd":   compressionZstd,
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCompressor) decompress(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
+
+// The encoder and decoder are safe for concurrent use and created on first
+// use, since they hold buffers a process without zstd never needs
+type zstdCompressor struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func (s *zstdCompressor) init() error {
+	s.once.Do(func() {
+		if s.encoder, s.err = zstd.NewWriter(nil); s.err != nil {
+			return
+		}
+
+		s.decoder, s.err = zstd.NewReader(nil)
+	})
+
+	return s.err
+}
+
+func (s *zstdCompressor) compress(data []byte) ([]byte, error) {
+	if err := s.init(); err != nil {
+		return nil, err
+	}
+
+	return s.encoder.EncodeAll(data, nil), nil
+}
+
+func (s *zstdCompressor) decompress(data []byte) ([]byte, error) {
+	if err := s.init(); err != nil {
+		return nil, err
+	}
+
+	return s.decoder.DecodeAll(data, nil)
+}
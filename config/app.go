@@ -10,10 +10,42 @@ type Worker struct {
 	Type       string          `json:"type"`
 	Manager    string          `json:"manager"`
 	Interval   time.Duration   `json:"interval"`
+	Cron       string          `json:"cron"`
+	Jitter     time.Duration   `json:"jitter"`
+	StatePath  string          `json:"state_path"`
 	Parameters json.RawMessage `json:"parameters"`
 	Inbox      string          `json:"inbox"`
 	Outbox     string          `json:"outbox"`
 	Count      int             `json:"count"`
+	// Deadline for a single OnMessage call, unlimited when unset
+	Timeout time.Duration `json:"timeout"`
+	// Bounds for autoscaling, the pool is fixed at Count when unset
+	MinCount int         `json:"min_count"`
+	MaxCount int         `json:"max_count"`
+	Retry    RetryPolicy `json:"retry"`
+	// Queue receiving messages that failed permanently or ran out of attempts
+	ErrorOutbox string `json:"error_outbox"`
+	// Published messages go to every matching route, or Outbox if none match
+	Routes []Route `json:"routes"`
+}
+
+// Matches published messages by type name, expression over the message, or
+// both. An empty route matches everything.
+type Route struct {
+	MessageType string `json:"message_type"`
+	Match       string `json:"match"`
+	Outbox      string `json:"outbox"`
+}
+
+// Failed messages are re-enqueued with exponential backoff when Backoff is set,
+// otherwise they are handed straight back to the inbox. A MaxAttempts of 0
+// retries forever.
+type RetryPolicy struct {
+	MaxAttempts int           `json:"max_attempts"`
+	Backoff     time.Duration `json:"backoff"`
+	MaxBackoff  time.Duration `json:"max_backoff"`
+	// Random extra delay of up to this long added to each retry
+	Jitter time.Duration `json:"jitter"`
 }
 
 type Resource struct {
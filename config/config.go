@@ -20,6 +20,26 @@ type HTTPClientConfig struct {
 	Socks5Url    string        `json:"socks5_url"`
 	HTTPProxyUrl string        `json:"http_proxy_url"`
 	MaxRetries   int           `json:"max_retries"`
+	// Redirects followed per request, 0 to follow none
+	MaxRedirects int `json:"max_redirects"`
+	// Credential profiles by name
+	Profiles map[string]HTTPProfile `json:"profiles"`
+}
+
+// Headers and credentials added to a request, either named by the request or
+// applied to every request for one of Hosts and its subdomains. Anything the
+// request already sets is left alone.
+type HTTPProfile struct {
+	Hosts       []string          `json:"hosts"`
+	Headers     map[string]string `json:"headers"`
+	Cookies     map[string]string `json:"cookies"`
+	BasicAuth   *BasicAuth        `json:"basic_auth"`
+	BearerToken string            `json:"bearer_token"`
+}
+
+type BasicAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
 type RobotsConfig struct {
@@ -60,11 +80,23 @@ type TransformerConfig struct {
 type WorkersConfig struct {
 	Enabled      bool `json:"enabled"`
 	WorkerCounts int  `json:"worker_counts"`
+	// How long in-flight messages may run on shutdown before being returned
+	// to their inbox
+	ShutdownGracePeriod time.Duration `json:"shutdown_grace_period"`
+}
+
+// Encoding of queued messages and their payloads
+type CodecConfig struct {
+	// json or msgpack
+	Format string `json:"format"`
+	// none, snappy or zstd
+	Compression string `json:"compression"`
 }
 
 type Config struct {
 	Workers WorkersConfig `json:"workers"`
 	Metrics MetricsConfig `json:"metrics"`
+	Codec   CodecConfig   `json:"codec"`
 	// TODO maybe this should be in the workers/resources mapping instead?
 	DefaultSaveInterval time.Duration       `json:"default_save_interval"`
 	CountriesPath       string              `json:"countries_path"`
@@ -81,8 +113,9 @@ func LoadConfig() Config {
 	// Put defaults here
 	return Config{
 		Workers: WorkersConfig{
-			Enabled:      true,
-			WorkerCounts: runtime.NumCPU() * 8,
+			Enabled:             true,
+			WorkerCounts:        runtime.NumCPU() * 8,
+			ShutdownGracePeriod: 30 * time.Second,
 		},
 		DefaultSaveInterval: 2 * time.Minute,
 		CompaniesPath:       DataFilePath("data", "companies.json"),
@@ -90,14 +123,19 @@ func LoadConfig() Config {
 		Metrics: MetricsConfig{
 			Enabled: true,
 		},
+		Codec: CodecConfig{
+			Format:      "json",
+			Compression: "none",
+		},
 		Adversarial: AdversarialConfig{
 			SubdomainThreshold:   25,
 			EnumerationThreshold: 1,
 		},
 		HTTPClient: HTTPClientConfig{
-			Timeout:    10 * time.Second,
-			MaxRetries: 1,
-			UserAgent:  "delver pre-alpha",
+			Timeout:      10 * time.Second,
+			MaxRetries:   1,
+			MaxRedirects: 10,
+			UserAgent:    "delver pre-alpha",
 		},
 		API: APIConfig{
 			Enabled:    true,
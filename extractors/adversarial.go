@@ -31,7 +31,7 @@ func (s *adversarialExtractor) Perform(f *os.File, composite message.CompositeAn
 		return nil, errors.Wrap(err, "adversarial extractor")
 	}
 
-	origin, err := url.Parse(composite.URI)
+	origin, err := url.Parse(composite.BaseURI())
 
 	if err != nil {
 		return nil, err
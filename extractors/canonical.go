@@ -0,0 +1,85 @@
+package extractors
+
+import (
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/iakinsey/delver/types/features"
+	"github.com/iakinsey/delver/types/message"
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+)
+
+type canonicalExtractor struct{}
+
+func NewCanonicalExtractor() Extractor {
+	return &canonicalExtractor{}
+}
+
+// Finds the <link rel="canonical"> of the page, resolved against the URI it
+// was fetched from
+func (s *canonicalExtractor) Perform(f *os.File, composite message.CompositeAnalysis) (interface{}, error) {
+	base, err := url.Parse(composite.BaseURI())
+
+	if err != nil {
+		return nil, err
+	}
+
+	document, err := html.Parse(f)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse html document for canonical extraction")
+	}
+
+	href, ok := seekCanonical(document)
+
+	if !ok {
+		return nil, nil
+	}
+
+	canonical, err := base.Parse(strings.TrimSpace(href))
+
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid canonical url")
+	}
+
+	return features.Canonical(canonical.String()), nil
+}
+
+func (s *canonicalExtractor) Name() string {
+	return features.CanonicalField
+}
+
+func (s *canonicalExtractor) Requires() []string {
+	return nil
+}
+
+func seekCanonical(node *html.Node) (string, bool) {
+	if node.Type == html.ElementNode && node.Data == "link" {
+		var rel, href string
+
+		for _, attr := range node.Attr {
+			switch strings.ToLower(attr.Key) {
+			case "rel":
+				rel = attr.Val
+			case "href":
+				href = attr.Val
+			}
+		}
+
+		for _, value := range strings.Fields(rel) {
+			if strings.EqualFold(value, "canonical") && href != "" {
+				return href, true
+			}
+		}
+	}
+
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if href, ok := seekCanonical(child); ok {
+			return href, ok
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,43 @@
+package extractors
+
+import (
+	"os"
+	"testing"
+
+	"github.com/iakinsey/delver/types/features"
+	"github.com/iakinsey/delver/types/message"
+	"github.com/iakinsey/delver/util"
+	"github.com/iakinsey/delver/util/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalExtractor(t *testing.T) {
+	extractor := NewCanonicalExtractor()
+	htmlFile := testutil.TestDataFile(exampleHtmlFile)
+	canonical, err := extractor.Perform(htmlFile, message.CompositeAnalysis{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, features.Canonical("https://en.wikipedia.org/wiki/Snail%27s_House"), canonical)
+}
+
+func TestCanonicalExtractorRelative(t *testing.T) {
+	path := util.NewTempPath("canonical.html")
+
+	defer os.Remove(path)
+
+	assert.NoError(t, os.WriteFile(path, []byte(`<html><head><link rel="Canonical" href="/page"></head></html>`), 0644))
+
+	f, _ := os.Open(path)
+	defer f.Close()
+
+	// Resolved against the final URI rather than the requested one
+	canonical, err := NewCanonicalExtractor().Perform(f, message.CompositeAnalysis{
+		FetcherResponse: message.FetcherResponse{
+			FetcherRequest: message.FetcherRequest{URI: "http://a.com/old"},
+			FinalURI:       "https://b.com/new",
+		},
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, features.Canonical("https://b.com/page"), canonical)
+}
@@ -17,7 +17,7 @@ func NewUrlExtractor() Extractor {
 }
 
 func (s *urlExtractor) Perform(f *os.File, composite message.CompositeAnalysis) (interface{}, error) {
-	base, err := url.Parse(composite.URI)
+	base, err := url.Parse(composite.BaseURI())
 
 	if err != nil {
 		return nil, err
@@ -1,5 +1,14 @@
 package frontier
 
+import "time"
+
 type Filter interface {
 	IsAllowed(url string) (bool, error)
 }
+
+// Robots.txt rules, which also say how often a host may be fetched
+type Robots interface {
+	Filter
+	// Crawl-delay for the host of the URL, 0 if it sets none
+	CrawlDelay(url string) (time.Duration, error)
+}
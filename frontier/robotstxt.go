@@ -28,7 +28,7 @@ type robotsInfo struct {
 	created time.Time
 }
 
-func NewMemoryRobots() Filter {
+func NewMemoryRobots() Robots {
 	conf := config.Get().Robots
 	clientConf := config.Get().HTTPClient
 
@@ -53,14 +53,10 @@ func (s *memoryRobots) IsAllowed(u string) (bool, error) {
 		return false, errors.Wrap(err, "failed to parse URL")
 	}
 
-	info := s.getRobots(meta)
+	info, err := s.lookup(meta)
 
-	if info == nil {
-		info, err = s.setRobots(meta)
-
-		if err != nil {
-			return true, errors.Wrap(err, "unable to parse robots file")
-		}
+	if err != nil {
+		return true, err
 	}
 
 	if info.robots == nil {
@@ -70,6 +66,36 @@ func (s *memoryRobots) IsAllowed(u string) (bool, error) {
 	return info.robots.TestAgent(meta.Path, s.userAgent), nil
 }
 
+func (s *memoryRobots) CrawlDelay(u string) (time.Duration, error) {
+	meta, err := url.Parse(u)
+
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to parse URL")
+	}
+
+	info, err := s.lookup(meta)
+
+	if err != nil || info.robots == nil {
+		return 0, err
+	}
+
+	if group := info.robots.FindGroup(s.userAgent); group != nil {
+		return group.CrawlDelay, nil
+	}
+
+	return 0, nil
+}
+
+func (s *memoryRobots) lookup(meta *url.URL) (*robotsInfo, error) {
+	if info := s.getRobots(meta); info != nil {
+		return info, nil
+	}
+
+	info, err := s.setRobots(meta)
+
+	return info, errors.Wrap(err, "unable to parse robots file")
+}
+
 func (s *memoryRobots) getRobots(meta *url.URL) *robotsInfo {
 	s.mapMutex.Lock()
 
@@ -37,6 +37,11 @@ func TestMemoryRobots(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, expectedState, actualState)
 	}
+
+	delay, err := memoryRobots.CrawlDelay(fmt.Sprintf("http://localhost:%d/good", testHttpServerPort))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Second, delay)
 }
 
 func startRobotsServer() {
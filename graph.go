@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iakinsey/delver/topology"
+)
+
+const topologyUsage = "usage: delver topology [-f dot|mermaid|json] <config>"
+
+// Prints how the workers and resources of an application config connect
+func PrintTopology(args []string) {
+	var format string
+
+	flags := flag.NewFlagSet("topology", flag.ExitOnError)
+	flags.StringVar(&format, "f", "dot", "output format: dot, mermaid or json")
+	flags.Usage = exitWithTopologyUsage
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		exitWithTopologyUsage()
+	}
+
+	g := topology.Build(LoadJsonConfig(flags.Arg(0)))
+
+	switch format {
+	case "dot":
+		fmt.Print(g.DOT())
+	case "mermaid":
+		fmt.Print(g.Mermaid())
+	case "json":
+		b, err := json.MarshalIndent(g, "", "  ")
+
+		if err != nil {
+			log.Fatalf("failed to encode topology: %s", err)
+		}
+
+		fmt.Println(string(b))
+	default:
+		exitWithTopologyUsage()
+	}
+}
+
+func exitWithTopologyUsage() {
+	fmt.Fprintln(os.Stderr, topologyUsage)
+	os.Exit(2)
+}
@@ -2,24 +2,60 @@ package instrument
 
 import (
 	"context"
-	"encoding/json"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/armon/go-metrics"
 	"github.com/iakinsey/delver/config"
-	"github.com/iakinsey/delver/queue"
 	"github.com/iakinsey/delver/types"
 	"github.com/iakinsey/delver/util"
 	"github.com/pkg/errors"
 )
 
-var metric metrics.MetricSink = &metrics.BlackholeSink{}
+var metric metrics.MetricSink = &totalingSink{MetricSink: &metrics.BlackholeSink{}}
+
+// Running totals of every counter since startup, keyed by the dot separated
+// metric name
+var totals = struct {
+	sync.Mutex
+	m map[string]float32
+}{m: make(map[string]float32)}
+
+// Keeps counter totals alongside the configured sink, which only holds
+// recent intervals if anything at all
+type totalingSink struct {
+	metrics.MetricSink
+}
+
+func (s *totalingSink) IncrCounter(key []string, val float32) {
+	addTotal(key, val)
+	s.MetricSink.IncrCounter(key, val)
+}
+
+func (s *totalingSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	addTotal(key, val)
+	s.MetricSink.IncrCounterWithLabels(key, val, labels)
+}
+
+func addTotal(key []string, val float32) {
+	totals.Lock()
+	defer totals.Unlock()
+
+	totals.m[strings.Join(key, ".")] += val
+}
+
+// Destination for encoded metrics, satisfied by queue.Queue. Kept narrow so
+// queue implementations can report metrics without an import cycle.
+type MetricsQueue interface {
+	Put(types.Message, int) error
+}
 
 type encoder struct {
-	transformerQueue queue.Queue
+	transformerQueue MetricsQueue
 }
 
-func NewMetricsEncoder(transformerQueue queue.Queue) metrics.Encoder {
+func NewMetricsEncoder(transformerQueue MetricsQueue) metrics.Encoder {
 	return &encoder{
 		transformerQueue: transformerQueue,
 	}
@@ -58,20 +94,20 @@ func (s *encoder) Encode(args interface{}) error {
 		})
 	}
 
-	if b, err := json.Marshal(out); err != nil {
+	if messageType, payload, err := types.EncodeMessage(out); err != nil {
 		return errors.Wrap(err, "failed to serialize metrics")
 	} else {
 		s.transformerQueue.Put(types.Message{
 			ID:          string(types.NewV4()),
-			MessageType: types.MetricType,
-			Message:     json.RawMessage(b),
+			MessageType: messageType,
+			Message:     payload,
 		}, 0)
 	}
 
 	return nil
 }
 
-func LoadMetrics(transformerQueue queue.Queue) metrics.MetricSink {
+func LoadMetrics(transformerQueue MetricsQueue) metrics.MetricSink {
 	conf := config.Get().Metrics
 
 	if !conf.Enabled {
@@ -90,10 +126,27 @@ type Encoder interface {
 	Encode(interface{}) error
 }
 
-func SetMetrics(transformerQueue queue.Queue) {
-	metric = LoadMetrics(transformerQueue)
+func SetMetrics(transformerQueue MetricsQueue) {
+	metric = &totalingSink{MetricSink: LoadMetrics(transformerQueue)}
 }
 
 func GetMetrics() metrics.MetricSink {
 	return metric
 }
+
+// Counter totals under a key prefix, keyed by the rest of their name
+func GetCounters(prefix ...string) map[string]float32 {
+	totals.Lock()
+	defer totals.Unlock()
+
+	p := strings.Join(prefix, ".") + "."
+	out := make(map[string]float32)
+
+	for key, val := range totals.m {
+		if strings.HasPrefix(key, p) {
+			out[strings.TrimPrefix(key, p)] = val
+		}
+	}
+
+	return out
+}
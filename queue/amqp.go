@@ -1 +1,356 @@
 package queue
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iakinsey/delver/codec"
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/resource"
+	"github.com/iakinsey/delver/types"
+)
+
+const amqpDefaultMaxPriority = 9
+const amqpDefaultPrefetch = 1
+const amqpDefaultPublishTimeout = 5 * time.Second
+const amqpDelayedSuffix = ".delayed"
+
+// Subset of *amqp.Channel used by the queue, allows for an in-process
+// stand-in during tests.
+type amqpChannel interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueuePurge(name string, noWait bool) (int, error)
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Close() error
+}
+
+type amqpQueue struct {
+	name           string
+	delayedName    string
+	consumerTag    string
+	durable        bool
+	maxPriority    int
+	prefetch       int
+	publishTimeout time.Duration
+	args           amqp.Table
+	conn           io.Closer
+	amqpChannel    amqpChannel
+	channel        chan types.Message
+	pending        map[string]amqp.Delivery
+	pendingLock    sync.Mutex
+	terminate      chan bool
+	terminated     chan bool
+}
+
+type AmqpQueueParams struct {
+	Name             string `json:"name"`
+	URL              string `json:"url"`
+	Durable          bool   `json:"durable"`
+	MaxPriority      int    `json:"max_priority"`
+	Prefetch         int    `json:"prefetch"`
+	PublishTimeoutMs int    `json:"publish_timeout_ms"`
+}
+
+func init() {
+	resource.Register("amqp_queue", resource.Factory{
+		Params: func(_ config.Resource) interface{} { return &AmqpQueueParams{} },
+		New: func(params interface{}) interface{} {
+			return NewAmqpQueue(*params.(*AmqpQueueParams))
+		},
+		Type: reflect.TypeOf((*Queue)(nil)).Elem(),
+	})
+}
+
+func NewAmqpQueue(params AmqpQueueParams) Queue {
+	conn, err := amqp.Dial(params.URL)
+
+	if err != nil {
+		log.Fatalf("failed to connect to amqp broker for queue %s: %s", params.Name, err)
+	}
+
+	ch, err := conn.Channel()
+
+	if err != nil {
+		log.Fatalf("failed to open amqp channel for queue %s: %s", params.Name, err)
+	}
+
+	q, err := newAmqpQueue(params, conn, ch)
+
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	return q
+}
+
+func newAmqpQueue(params AmqpQueueParams, conn io.Closer, ch amqpChannel) (*amqpQueue, error) {
+	if params.Name == "" {
+		return nil, errors.New("amqp queue requires a name")
+	}
+
+	maxPriority := params.MaxPriority
+	prefetch := params.Prefetch
+	publishTimeout := time.Duration(params.PublishTimeoutMs) * time.Millisecond
+
+	if maxPriority <= 0 || maxPriority > 255 {
+		maxPriority = amqpDefaultMaxPriority
+	}
+
+	if prefetch <= 0 {
+		prefetch = amqpDefaultPrefetch
+	}
+
+	if publishTimeout <= 0 {
+		publishTimeout = amqpDefaultPublishTimeout
+	}
+
+	args := amqp.Table{"x-max-priority": int32(maxPriority)}
+
+	if _, err := ch.QueueDeclare(params.Name, params.Durable, false, false, false, args); err != nil {
+		return nil, errors.Wrapf(err, "failed to declare amqp queue %s", params.Name)
+	}
+
+	delayedName := params.Name + amqpDelayedSuffix
+	delayedArgs := amqp.Table{
+		"x-max-priority":            int32(maxPriority),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": params.Name,
+	}
+
+	if _, err := ch.QueueDeclare(delayedName, params.Durable, false, false, false, delayedArgs); err != nil {
+		return nil, errors.Wrapf(err, "failed to declare amqp queue %s", delayedName)
+	}
+
+	if err := ch.Qos(prefetch, 0, false); err != nil {
+		return nil, errors.Wrapf(err, "failed to set amqp prefetch for queue %s", params.Name)
+	}
+
+	return &amqpQueue{
+		name:           params.Name,
+		delayedName:    delayedName,
+		consumerTag:    fmt.Sprintf("%s-%s", params.Name, types.NewV4()),
+		durable:        params.Durable,
+		maxPriority:    maxPriority,
+		prefetch:       prefetch,
+		publishTimeout: publishTimeout,
+		args:           args,
+		conn:           conn,
+		amqpChannel:    ch,
+		channel:        make(chan types.Message),
+		pending:        make(map[string]amqp.Delivery),
+		terminate:      make(chan bool),
+		terminated:     make(chan bool),
+	}, nil
+}
+
+func (s *amqpQueue) Start() error {
+	deliveries, err := s.amqpChannel.Consume(s.name, s.consumerTag, false, false, false, false, nil)
+
+	if err != nil {
+		return errors.Wrapf(err, "failed to consume amqp queue %s", s.name)
+	}
+
+	go s.perform(deliveries)
+
+	return nil
+}
+
+func (s *amqpQueue) Stop() error {
+	var result error
+
+	s.terminate <- true
+	<-s.terminated
+
+	if err := s.amqpChannel.Cancel(s.consumerTag, false); err != nil {
+		result = errors.Wrap(err, "failed to cancel amqp consumer")
+	}
+
+	// Unacknowledged deliveries are requeued by the broker once the channel closes
+	if err := s.amqpChannel.Close(); err != nil && result == nil {
+		result = errors.Wrap(err, "failed to close amqp channel")
+	}
+
+	if s.conn == nil {
+		return result
+	}
+
+	if err := s.conn.Close(); err != nil && result == nil {
+		result = errors.Wrap(err, "failed to close amqp connection")
+	}
+
+	return result
+}
+
+func (s *amqpQueue) GetChannel() chan types.Message {
+	return s.channel
+}
+
+func (s *amqpQueue) Put(message types.Message, priority int) error {
+	return s.publish(s.name, message, priority, "")
+}
+
+// Delayed messages wait in a companion queue until their per-message TTL
+// expires, then are dead-lettered into the main queue. Brokers only expire
+// messages at the head of a queue, so a long delay holds back shorter delays
+// published after it.
+func (s *amqpQueue) PutAt(message types.Message, priority int, notBefore time.Time) error {
+	delay := time.Until(notBefore)
+
+	if delay <= 0 {
+		return s.Put(message, priority)
+	}
+
+	return s.publish(s.delayedName, message, priority, strconv.FormatInt(delay.Milliseconds(), 10))
+}
+
+func (s *amqpQueue) publish(key string, message types.Message, priority int, expiration string) error {
+	message.ID = string(types.NewV4())
+	c := codec.Get()
+	payload, err := c.Marshal(message)
+
+	if err != nil {
+		return errors.Wrap(err, "failed to serialize message for amqp put")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.publishTimeout)
+	defer cancel()
+
+	deliveryMode := amqp.Transient
+
+	if s.durable {
+		deliveryMode = amqp.Persistent
+	}
+
+	err = s.amqpChannel.PublishWithContext(ctx, "", key, false, false, amqp.Publishing{
+		ContentType:   c.ContentType(),
+		DeliveryMode:  deliveryMode,
+		Priority:      s.getAmqpPriority(priority),
+		MessageId:     message.ID,
+		CorrelationId: message.Headers.TraceID,
+		Timestamp:     time.Now(),
+		Expiration:    expiration,
+		Body:          payload,
+	})
+
+	return errors.Wrap(err, "failed to publish message for amqp put")
+}
+
+func (s *amqpQueue) Prepare() error {
+	return nil
+}
+
+func (s *amqpQueue) EndTransaction(message types.Message, success bool) error {
+	s.pendingLock.Lock()
+	delivery, ok := s.pending[message.ID]
+	delete(s.pending, message.ID)
+	s.pendingLock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no pending amqp delivery for message %s", message.ID)
+	}
+
+	if success {
+		return errors.Wrap(delivery.Ack(false), "failed to ack amqp delivery")
+	}
+
+	return errors.Wrap(delivery.Nack(false, true), "failed to nack amqp delivery")
+}
+
+func (s *amqpQueue) Len() int64 {
+	q, err := s.amqpChannel.QueueDeclarePassive(s.name, s.durable, false, false, false, s.args)
+
+	if err != nil {
+		log.Errorf("failed to inspect amqp queue %s: %s", s.name, err)
+		return -1
+	}
+
+	return int64(q.Messages)
+}
+
+// Only ready messages are removed, delayed and unacknowledged ones remain
+func (s *amqpQueue) Purge() (int, error) {
+	count, err := s.amqpChannel.QueuePurge(s.name, false)
+
+	return count, errors.Wrap(err, "failed to purge amqp queue")
+}
+
+func (s *amqpQueue) perform(deliveries <-chan amqp.Delivery) {
+	for {
+		select {
+		case delivery, ok := <-deliveries:
+			if !ok {
+				log.Errorf("amqp consumer for queue %s closed", s.name)
+				<-s.terminate
+				s.terminated <- true
+				return
+			}
+
+			message, err := s.getDeliveryMessage(delivery)
+
+			if err != nil {
+				log.Error(err)
+
+				if err := delivery.Nack(false, false); err != nil {
+					log.Errorf("failed to discard malformed amqp delivery: %s", err)
+				}
+
+				continue
+			}
+
+			s.pendingLock.Lock()
+			s.pending[message.ID] = delivery
+			s.pendingLock.Unlock()
+
+			select {
+			case s.channel <- *message:
+			case <-s.terminate:
+				s.terminated <- true
+				return
+			}
+		case <-s.terminate:
+			s.terminated <- true
+			return
+		}
+	}
+}
+
+func (s *amqpQueue) getDeliveryMessage(delivery amqp.Delivery) (*types.Message, error) {
+	message := types.Message{}
+
+	if err := codec.Unmarshal(delivery.Body, &message); err != nil {
+		return nil, errors.Wrap(err, "error while parsing amqp message")
+	}
+
+	if delivery.MessageId != "" {
+		message.ID = delivery.MessageId
+	} else if message.ID == "" {
+		message.ID = string(types.NewV4())
+	}
+
+	return &message, nil
+}
+
+// Lower priority values are delivered first, matching the ordering of fileQueue.
+// AMQP delivers higher priorities first, so the value is inverted.
+func (s *amqpQueue) getAmqpPriority(priority int) uint8 {
+	if priority < 0 {
+		priority = 0
+	} else if priority > s.maxPriority {
+		priority = s.maxPriority
+	}
+
+	return uint8(s.maxPriority - priority)
+}
@@ -0,0 +1,272 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iakinsey/delver/types"
+)
+
+// In-process stand-in for a single AMQP 0-9-1 channel bound to one queue.
+// Publishes to the delayed companion queue are dead-lettered into the main
+// queue once their expiration passes.
+type fakeAmqpBroker struct {
+	lock     sync.Mutex
+	prefetch int
+	tag      uint64
+	ready    []amqp.Publishing
+	unacked  map[uint64]amqp.Publishing
+	notify   chan bool
+	cancel   chan bool
+	once     sync.Once
+}
+
+func newFakeAmqpBroker() *fakeAmqpBroker {
+	return &fakeAmqpBroker{
+		unacked: make(map[uint64]amqp.Publishing),
+		notify:  make(chan bool, 1),
+		cancel:  make(chan bool),
+	}
+}
+
+func (s *fakeAmqpBroker) Qos(prefetchCount, prefetchSize int, global bool) error {
+	s.prefetch = prefetchCount
+
+	return nil
+}
+
+func (s *fakeAmqpBroker) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, nil
+}
+
+func (s *fakeAmqpBroker) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return amqp.Queue{Name: name, Messages: len(s.ready)}, nil
+}
+
+func (s *fakeAmqpBroker) QueuePurge(name string, noWait bool) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	count := len(s.ready)
+	s.ready = nil
+
+	return count, nil
+}
+
+func (s *fakeAmqpBroker) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	out := make(chan amqp.Delivery)
+
+	go func() {
+		defer close(out)
+
+		for {
+			if delivery, ok := s.pop(); ok {
+				select {
+				case out <- delivery:
+				case <-s.cancel:
+					return
+				}
+
+				continue
+			}
+
+			select {
+			case <-s.notify:
+			case <-s.cancel:
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (s *fakeAmqpBroker) Cancel(consumer string, noWait bool) error {
+	s.once.Do(func() { close(s.cancel) })
+
+	return nil
+}
+
+func (s *fakeAmqpBroker) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if strings.HasSuffix(key, amqpDelayedSuffix) {
+		ttl, err := strconv.Atoi(msg.Expiration)
+
+		if err != nil {
+			return err
+		}
+
+		msg.Expiration = ""
+
+		time.AfterFunc(time.Duration(ttl)*time.Millisecond, func() {
+			s.PublishWithContext(ctx, exchange, strings.TrimSuffix(key, amqpDelayedSuffix), mandatory, immediate, msg)
+		})
+
+		return nil
+	}
+
+	s.lock.Lock()
+	s.ready = append(s.ready, msg)
+	s.lock.Unlock()
+	s.signal()
+
+	return nil
+}
+
+func (s *fakeAmqpBroker) Close() error {
+	return s.Cancel("", false)
+}
+
+func (s *fakeAmqpBroker) Ack(tag uint64, multiple bool) error {
+	s.lock.Lock()
+	delete(s.unacked, tag)
+	s.lock.Unlock()
+	s.signal()
+
+	return nil
+}
+
+func (s *fakeAmqpBroker) Nack(tag uint64, multiple bool, requeue bool) error {
+	s.lock.Lock()
+
+	if msg, ok := s.unacked[tag]; ok && requeue {
+		s.ready = append([]amqp.Publishing{msg}, s.ready...)
+	}
+
+	delete(s.unacked, tag)
+	s.lock.Unlock()
+	s.signal()
+
+	return nil
+}
+
+func (s *fakeAmqpBroker) Reject(tag uint64, requeue bool) error {
+	return s.Nack(tag, false, requeue)
+}
+
+func (s *fakeAmqpBroker) signal() {
+	select {
+	case s.notify <- true:
+	default:
+	}
+}
+
+func (s *fakeAmqpBroker) pop() (amqp.Delivery, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.ready) == 0 || (s.prefetch > 0 && len(s.unacked) >= s.prefetch) {
+		return amqp.Delivery{}, false
+	}
+
+	best := 0
+
+	for i, msg := range s.ready {
+		if msg.Priority > s.ready[best].Priority {
+			best = i
+		}
+	}
+
+	msg := s.ready[best]
+	s.ready = append(s.ready[:best], s.ready[best+1:]...)
+	s.tag += 1
+	s.unacked[s.tag] = msg
+
+	return amqp.Delivery{
+		Acknowledger: s,
+		DeliveryTag:  s.tag,
+		MessageId:    msg.MessageId,
+		Priority:     msg.Priority,
+		Body:         msg.Body,
+	}, true
+}
+
+func newTestAmqpMessage(body string) types.Message {
+	b, _ := json.Marshal(body)
+
+	return types.Message{
+		MessageType: types.FetcherRequestType,
+		Message:     types.Payload(b),
+	}
+}
+
+func TestAmqpQueue(t *testing.T) {
+	broker := newFakeAmqpBroker()
+	q, err := newAmqpQueue(AmqpQueueParams{Name: "TestAmqpQueue"}, nil, broker)
+
+	assert.NoError(t, err)
+	assert.NoError(t, q.Put(newTestAmqpMessage("low"), 5))
+	assert.NoError(t, q.Put(newTestAmqpMessage("high"), 0))
+	assert.Equal(t, int64(2), q.Len())
+	assert.NoError(t, q.Start())
+
+	msg := <-q.GetChannel()
+
+	assert.Equal(t, `"high"`, string(msg.Message))
+	assert.Equal(t, types.FetcherRequestType, msg.MessageType)
+	assert.NoError(t, q.EndTransaction(msg, false))
+
+	msg = <-q.GetChannel()
+
+	assert.Equal(t, `"high"`, string(msg.Message))
+	assert.NoError(t, q.EndTransaction(msg, true))
+
+	msg = <-q.GetChannel()
+
+	assert.Equal(t, `"low"`, string(msg.Message))
+	assert.NoError(t, q.EndTransaction(msg, true))
+	assert.Error(t, q.EndTransaction(msg, true))
+	assert.Equal(t, int64(0), q.Len())
+	assert.NoError(t, q.Stop())
+}
+
+func TestAmqpQueueDiscardsMalformed(t *testing.T) {
+	broker := newFakeAmqpBroker()
+	q, err := newAmqpQueue(AmqpQueueParams{Name: "TestAmqpQueue"}, nil, broker)
+
+	assert.NoError(t, err)
+	assert.NoError(t, broker.PublishWithContext(context.Background(), "", "TestAmqpQueue", false, false, amqp.Publishing{
+		Priority: amqpDefaultMaxPriority,
+		Body:     []byte("{not json"),
+	}))
+	assert.NoError(t, q.Put(newTestAmqpMessage("valid"), 5))
+	assert.NoError(t, q.Start())
+
+	msg := <-q.GetChannel()
+
+	assert.Equal(t, `"valid"`, string(msg.Message))
+	assert.NoError(t, q.EndTransaction(msg, true))
+	assert.Equal(t, int64(0), q.Len())
+	assert.NoError(t, q.Stop())
+}
+
+func TestAmqpQueuePutAt(t *testing.T) {
+	broker := newFakeAmqpBroker()
+	q, err := newAmqpQueue(AmqpQueueParams{Name: "TestAmqpQueue"}, nil, broker)
+
+	assert.NoError(t, err)
+	assert.NoError(t, q.PutAt(newTestAmqpMessage("delayed"), 0, time.Now().Add(20*time.Millisecond)))
+	assert.NoError(t, q.Put(newTestAmqpMessage("ready"), 5))
+	assert.NoError(t, q.Start())
+
+	msg := <-q.GetChannel()
+
+	assert.Equal(t, `"ready"`, string(msg.Message))
+	assert.NoError(t, q.EndTransaction(msg, true))
+
+	msg = <-q.GetChannel()
+
+	assert.Equal(t, `"delayed"`, string(msg.Message))
+	assert.NoError(t, q.EndTransaction(msg, true))
+	assert.NoError(t, q.Stop())
+}
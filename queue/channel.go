@@ -1,22 +1,145 @@
 package queue
 
-import "github.com/iakinsey/delver/types"
+import (
+	"reflect"
+	"sync"
+	"time"
 
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/resource"
+	"github.com/iakinsey/delver/types"
+)
+
+const overflowDropOldest = "drop_oldest"
+const defaultChannelBufferSize = 1024
+const defaultChannelDrainTimeout = time.Second
+
+// In-memory queue. Messages are buffered in priority lanes, a lower priority
+// value is delivered first, and handed to consumers through an unbuffered
+// channel.
 type channelQueue struct {
-	channel chan types.Message
+	name         string
+	channel      chan types.Message
+	lanes        [][]types.Message
+	size         int
+	bufferSize   int
+	overflow     string
+	blockTimeout time.Duration
+	drainTimeout time.Duration
+	lock         sync.Mutex
+	notify       chan bool
+	space        chan bool
+	terminate    chan bool
+	terminated   chan bool
+	running      bool
 }
 
-func NewChannelQueue() Queue {
+type ChannelQueueParams struct {
+	Name       string `json:"name"`
+	BufferSize int    `json:"buffer_size"`
+	// One of block, drop_oldest or reject
+	OverflowPolicy string `json:"overflow_policy"`
+	BlockTimeoutMs int    `json:"block_timeout_ms"`
+	// Number of priority lanes, priorities beyond the last lane share it
+	Lanes          int `json:"lanes"`
+	DrainTimeoutMs int `json:"drain_timeout_ms"`
+}
+
+func init() {
+	resource.Register("channel_queue", resource.Factory{
+		Params: func(conf config.Resource) interface{} { return &ChannelQueueParams{Name: conf.Name} },
+		New: func(params interface{}) interface{} {
+			return NewChannelQueue(*params.(*ChannelQueueParams))
+		},
+		Type: reflect.TypeOf((*Queue)(nil)).Elem(),
+	})
+}
+
+func NewChannelQueue(params ChannelQueueParams) Queue {
+	overflow := params.OverflowPolicy
+
+	switch overflow {
+	case "":
+		overflow = overflowBlock
+	case overflowBlock, overflowDropOldest, overflowReject:
+	default:
+		log.Fatalf("Queue %s has unknown overflow policy %s", params.Name, overflow)
+	}
+
+	bufferSize := params.BufferSize
+
+	if bufferSize <= 0 {
+		bufferSize = defaultChannelBufferSize
+	}
+
+	lanes := params.Lanes
+
+	if lanes <= 0 {
+		lanes = 1
+	}
+
+	drainTimeout := defaultChannelDrainTimeout
+
+	if params.DrainTimeoutMs > 0 {
+		drainTimeout = time.Duration(params.DrainTimeoutMs) * time.Millisecond
+	}
+
 	return &channelQueue{
-		channel: make(chan types.Message),
+		name:         params.Name,
+		channel:      make(chan types.Message),
+		lanes:        make([][]types.Message, lanes),
+		bufferSize:   bufferSize,
+		overflow:     overflow,
+		blockTimeout: time.Duration(params.BlockTimeoutMs) * time.Millisecond,
+		drainTimeout: drainTimeout,
+		notify:       make(chan bool, 1),
+		space:        make(chan bool, 1),
+		terminate:    make(chan bool),
+		terminated:   make(chan bool),
 	}
 }
 
 func (s *channelQueue) Start() error {
+	s.lock.Lock()
+	s.running = true
+	s.lock.Unlock()
+
+	go s.perform()
+
 	return nil
 }
 
+// Waits for buffered messages to be consumed before shutting down, anything
+// left once the drain timeout passes is dropped
 func (s *channelQueue) Stop() error {
+	s.lock.Lock()
+	running := s.running
+	s.running = false
+	s.lock.Unlock()
+
+	if !running {
+		return nil
+	}
+
+	deadline := time.After(s.drainTimeout)
+
+	for s.Len() > 0 {
+		select {
+		case <-s.space:
+		case <-time.After(overflowPollDelay):
+		case <-deadline:
+			log.Warnf("%s: dropping %d undelivered messages at shutdown", s.name, s.Len())
+			s.terminate <- true
+			<-s.terminated
+			return nil
+		}
+	}
+
+	s.terminate <- true
+	<-s.terminated
+
 	return nil
 }
 
@@ -25,7 +148,51 @@ func (s *channelQueue) GetChannel() chan types.Message {
 }
 
 func (s *channelQueue) Put(msg types.Message, priority int) error {
-	s.channel <- msg
+	var deadline <-chan time.Time
+
+	if s.blockTimeout > 0 {
+		deadline = time.After(s.blockTimeout)
+	}
+
+	for {
+		s.lock.Lock()
+
+		if s.size < s.bufferSize || (s.overflow == overflowDropOldest && s.dropOldest()) {
+			s.push(msg, priority)
+			s.lock.Unlock()
+			s.signal()
+
+			return nil
+		}
+
+		s.lock.Unlock()
+
+		if s.overflow != overflowBlock {
+			return ErrQueueFull
+		}
+
+		select {
+		case <-s.space:
+		case <-time.After(overflowPollDelay):
+		case <-deadline:
+			return ErrQueueFull
+		}
+	}
+}
+
+// Delayed messages are held in memory and lost if the process exits first
+func (s *channelQueue) PutAt(msg types.Message, priority int, notBefore time.Time) error {
+	delay := time.Until(notBefore)
+
+	if delay <= 0 {
+		return s.Put(msg, priority)
+	}
+
+	time.AfterFunc(delay, func() {
+		if err := s.Put(msg, priority); err != nil {
+			log.Errorf("%s: failed to deliver delayed message: %s", s.name, err)
+		}
+	})
 
 	return nil
 }
@@ -39,5 +206,140 @@ func (s *channelQueue) EndTransaction(types.Message, bool) error {
 }
 
 func (s *channelQueue) Len() int64 {
-	return int64(len(s.channel))
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return int64(s.size)
+}
+
+func (s *channelQueue) Full() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.overflow != overflowDropOldest && s.size >= s.bufferSize
+}
+
+func (s *channelQueue) Peek(limit int) ([]types.Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var messages []types.Message
+
+	for _, lane := range s.lanes {
+		for _, msg := range lane {
+			if limit > 0 && len(messages) >= limit {
+				return messages, nil
+			}
+
+			messages = append(messages, msg)
+		}
+	}
+
+	return messages, nil
+}
+
+func (s *channelQueue) Purge() (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	count := 0
+
+	for i, lane := range s.lanes {
+		count += len(lane)
+		s.lanes[i] = nil
+	}
+
+	s.size -= count
+
+	return count, nil
+}
+
+func (s *channelQueue) perform() {
+	for {
+		msg, ok := s.pop()
+
+		if !ok {
+			select {
+			case <-s.notify:
+				continue
+			case <-s.terminate:
+				s.terminated <- true
+				return
+			}
+		}
+
+		select {
+		case s.channel <- msg:
+			s.free()
+		case <-s.terminate:
+			s.terminated <- true
+			return
+		}
+	}
+}
+
+// Must be called with the lock held
+func (s *channelQueue) push(msg types.Message, priority int) {
+	lane := priority
+
+	if lane < 0 {
+		lane = 0
+	} else if lane >= len(s.lanes) {
+		lane = len(s.lanes) - 1
+	}
+
+	s.lanes[lane] = append(s.lanes[lane], msg)
+	s.size += 1
+}
+
+// Discards the oldest message of the least urgent non-empty lane. Must be
+// called with the lock held.
+func (s *channelQueue) dropOldest() bool {
+	for i := len(s.lanes) - 1; i >= 0; i-- {
+		if len(s.lanes[i]) > 0 {
+			s.lanes[i] = s.lanes[i][1:]
+			s.size -= 1
+			log.Warnf("%s: queue full, dropped oldest message", s.name)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// Takes the head of the most urgent lane. The message still counts towards
+// the queue size until it has been handed to a consumer.
+func (s *channelQueue) pop() (types.Message, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, lane := range s.lanes {
+		if len(lane) > 0 {
+			msg := lane[0]
+			s.lanes[i] = lane[1:]
+
+			return msg, true
+		}
+	}
+
+	return types.Message{}, false
+}
+
+func (s *channelQueue) free() {
+	s.lock.Lock()
+	s.size -= 1
+	s.lock.Unlock()
+
+	select {
+	case s.space <- true:
+	default:
+	}
+}
+
+func (s *channelQueue) signal() {
+	select {
+	case s.notify <- true:
+	default:
+	}
 }
@@ -0,0 +1,91 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iakinsey/delver/types"
+)
+
+func newTestChannelMessage(id string) types.Message {
+	return types.Message{ID: id, MessageType: types.FetcherRequestType}
+}
+
+func TestChannelQueuePriority(t *testing.T) {
+	q := NewChannelQueue(ChannelQueueParams{Name: "TestChannelQueue", Lanes: 3})
+
+	assert.NoError(t, q.Put(newTestChannelMessage("low"), 5))
+	assert.NoError(t, q.Put(newTestChannelMessage("high"), 0))
+	assert.NoError(t, q.Put(newTestChannelMessage("mid"), 1))
+	assert.Equal(t, int64(3), q.Len())
+	assert.NoError(t, q.Start())
+
+	for _, id := range []string{"high", "mid", "low"} {
+		msg := <-q.GetChannel()
+		assert.Equal(t, id, msg.ID)
+	}
+
+	assert.NoError(t, q.Stop())
+	assert.Equal(t, int64(0), q.Len())
+}
+
+func TestChannelQueueOverflow(t *testing.T) {
+	q := NewChannelQueue(ChannelQueueParams{
+		Name:           "TestChannelQueue",
+		BufferSize:     2,
+		OverflowPolicy: overflowReject,
+	})
+
+	assert.NoError(t, q.Put(newTestChannelMessage("0"), 0))
+	assert.NoError(t, q.Put(newTestChannelMessage("1"), 0))
+	assert.True(t, q.(BoundedQueue).Full())
+	assert.Equal(t, ErrQueueFull, q.Put(newTestChannelMessage("2"), 0))
+
+	q = NewChannelQueue(ChannelQueueParams{
+		Name:           "TestChannelQueue",
+		BufferSize:     1,
+		BlockTimeoutMs: 10,
+	})
+
+	assert.NoError(t, q.Put(newTestChannelMessage("0"), 0))
+	assert.Equal(t, ErrQueueFull, q.Put(newTestChannelMessage("1"), 0))
+
+	q = NewChannelQueue(ChannelQueueParams{
+		Name:           "TestChannelQueue",
+		BufferSize:     2,
+		OverflowPolicy: overflowDropOldest,
+	})
+
+	for _, id := range []string{"0", "1", "2"} {
+		assert.NoError(t, q.Put(newTestChannelMessage(id), 0))
+	}
+
+	assert.Equal(t, int64(2), q.Len())
+	assert.NoError(t, q.Start())
+	assert.Equal(t, "1", (<-q.GetChannel()).ID)
+	assert.Equal(t, "2", (<-q.GetChannel()).ID)
+	assert.NoError(t, q.Stop())
+}
+
+func TestChannelQueueDrainOnStop(t *testing.T) {
+	q := NewChannelQueue(ChannelQueueParams{Name: "TestChannelQueue"})
+	received := make(chan types.Message, 2)
+
+	assert.NoError(t, q.Put(newTestChannelMessage("0"), 0))
+	assert.NoError(t, q.Put(newTestChannelMessage("1"), 0))
+	assert.NoError(t, q.Start())
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			time.Sleep(10 * time.Millisecond)
+			received <- <-q.GetChannel()
+		}
+	}()
+
+	assert.NoError(t, q.Stop())
+	assert.Equal(t, int64(0), q.Len())
+	assert.Equal(t, "0", (<-received).ID)
+	assert.Equal(t, "1", (<-received).ID)
+}
@@ -0,0 +1,44 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+	from := time.Date(2024, time.March, 15, 10, 30, 20, 0, time.UTC)
+	cases := map[string]time.Time{
+		"@hourly":         time.Date(2024, time.March, 15, 11, 0, 0, 0, time.UTC),
+		"*/20 * * * *":    time.Date(2024, time.March, 15, 10, 40, 0, 0, time.UTC),
+		"0 1-5 * * *":     time.Date(2024, time.March, 16, 1, 0, 0, 0, time.UTC),
+		"15 9 * * 1":      time.Date(2024, time.March, 18, 9, 15, 0, 0, time.UTC),
+		"0 0 1,20 * 7":    time.Date(2024, time.March, 17, 0, 0, 0, 0, time.UTC),
+		"0 0 29 2 *":      time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC).AddDate(4, 0, 0),
+		"30 10 15 3 *":    time.Date(2025, time.March, 15, 10, 30, 0, 0, time.UTC),
+		"0 22-23,0-5 * *": {},
+	}
+
+	for expr, expected := range cases {
+		schedule, err := parseCron(expr)
+
+		if expected.IsZero() {
+			assert.Error(t, err, expr)
+			continue
+		}
+
+		assert.NoError(t, err, expr)
+		assert.Equal(t, expected, schedule.Next(from), expr)
+	}
+
+	for _, expr := range []string{"60 * * * *", "* * * *", "5-1 * * * *", "*/0 * * * *"} {
+		_, err := parseCron(expr)
+		assert.Error(t, err, expr)
+	}
+
+	schedule, err := parseCron("0 0 30 2 *")
+
+	assert.NoError(t, err)
+	assert.True(t, schedule.Next(from).IsZero())
+}
@@ -7,7 +7,9 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -15,16 +17,29 @@ import (
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/iakinsey/delver/codec"
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/instrument"
+	"github.com/iakinsey/delver/resource"
 	"github.com/iakinsey/delver/types"
+	// Registers the built-in message types checked on put and read
+	_ "github.com/iakinsey/delver/types/message"
 	"github.com/iakinsey/delver/util"
 	"github.com/pkg/errors"
 )
 
 const claimedSuffix = ".claimed"
 const writingSuffix = ".writing"
+const deadLetterReasonSuffix = ".error"
 const nameRegex = `[a-zA-Z0-9_-]+`
 const identifierRegex = `^\d+-\d+-\d+-` + nameRegex + "$"
 
+const overflowBlock = "block"
+const overflowReject = "reject"
+const overflowSpill = "spill"
+const overflowPollDelay = 50 * time.Millisecond
+const staleWritingAge = time.Minute
+
 var errQueueEmpty = errors.New("queue is empty")
 
 type fileQueue struct {
@@ -32,8 +47,12 @@ type fileQueue struct {
 	path         string
 	dlqPath      string
 	maxPollDelay time.Duration
-	// TODO
-	maxSize        int
+	maxSize      int
+	// Messages on disk, including claimed messages
+	size           int64
+	overflow       string
+	blockTimeout   time.Duration
+	space          chan bool
 	channel        chan types.Message
 	terminate      chan bool
 	terminated     chan bool
@@ -43,16 +62,51 @@ type fileQueue struct {
 	entityRegex    *regexp.Regexp
 	reset          bool
 	termLock       sync.Mutex
+	// Failed deliveries are counted in the Attempts of the message file, so
+	// the count survives restarts
+	maxAttempts int
+	// Claimed messages are returned to the queue after this long, 0 disables
+	visibilityTimeout time.Duration
+	claims            map[string]fileClaim
+	claimCounter      uint64
+	claimsLock        sync.Mutex
+}
+
+// Each claim of a message gets a new token, so a consumer whose claim expired
+// can't end the transaction of whoever claimed the message next
+type fileClaim struct {
+	token uint64
+	at    time.Time
+}
+
+type deadLetterReason struct {
+	Reason    string `json:"reason"`
+	Attempts  int    `json:"attempts"`
+	Timestamp int64  `json:"timestamp"`
 }
 
 type FileQueueParams struct {
-	Name           string `json:"name"`
-	Path           string `json:"path"`
-	DlqPath        string `json:"dlq_path"`
-	MaxPollDelayMs int    `json:"max_poll_delay_ms"`
-	MaxSize        int    `json:"max_size"`
-	Reset          bool   `json:"reset"`
-	Resilient      bool   `json:"resilient"`
+	Name                string `json:"name"`
+	Path                string `json:"path"`
+	DlqPath             string `json:"dlq_path"`
+	MaxPollDelayMs      int    `json:"max_poll_delay_ms"`
+	MaxSize             int    `json:"max_size"`
+	Reset               bool   `json:"reset"`
+	Resilient           bool   `json:"resilient"`
+	MaxAttempts         int    `json:"max_attempts"`
+	OverflowPolicy      string `json:"overflow_policy"`
+	BlockTimeoutMs      int    `json:"block_timeout_ms"`
+	VisibilityTimeoutMs int    `json:"visibility_timeout_ms"`
+}
+
+func init() {
+	resource.Register("file_queue", resource.Factory{
+		Params: func(_ config.Resource) interface{} { return &FileQueueParams{Resilient: true} },
+		New: func(params interface{}) interface{} {
+			return NewFileQueue(*params.(*FileQueueParams))
+		},
+		Type: reflect.TypeOf((*Queue)(nil)).Elem(),
+	})
 }
 
 func NewFileQueue(params FileQueueParams) Queue {
@@ -80,26 +134,80 @@ func NewFileQueue(params FileQueueParams) Queue {
 		log.Fatalf(err.Error())
 	}
 
-	return &fileQueue{
-		name:           params.Name,
-		path:           params.Path,
-		dlqPath:        params.DlqPath,
-		maxPollDelay:   time.Duration(params.MaxPollDelayMs) * time.Millisecond,
-		maxSize:        params.MaxSize,
-		channel:        make(chan types.Message),
-		terminating:    false,
-		terminate:      make(chan bool),
-		terminated:     make(chan bool),
-		resilient:      params.Resilient,
-		messageCounter: 0,
-		entityRegex:    entityRegex,
-		reset:          params.Reset,
+	overflow := params.OverflowPolicy
+
+	switch overflow {
+	case "":
+		overflow = overflowBlock
+	case overflowBlock, overflowReject, overflowSpill:
+	default:
+		log.Fatalf("Queue %s has unknown overflow policy %s", params.Name, overflow)
+	}
+
+	size, err := countQueueEntities(params.Path, entityRegex)
+
+	if err != nil {
+		log.Fatalf(err.Error())
 	}
+
+	q := &fileQueue{
+		name:              params.Name,
+		path:              params.Path,
+		dlqPath:           params.DlqPath,
+		maxPollDelay:      time.Duration(params.MaxPollDelayMs) * time.Millisecond,
+		maxSize:           params.MaxSize,
+		size:              size,
+		overflow:          overflow,
+		blockTimeout:      time.Duration(params.BlockTimeoutMs) * time.Millisecond,
+		space:             make(chan bool, 1),
+		channel:           make(chan types.Message),
+		terminating:       false,
+		terminate:         make(chan bool),
+		terminated:        make(chan bool),
+		resilient:         params.Resilient,
+		messageCounter:    0,
+		entityRegex:       entityRegex,
+		reset:             params.Reset,
+		maxAttempts:       params.MaxAttempts,
+		visibilityTimeout: time.Duration(params.VisibilityTimeoutMs) * time.Millisecond,
+		claims:            make(map[string]fileClaim),
+	}
+
+	if err := q.recoverFiles(); err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	return q
+}
+
+// Opens a file queue for Len and Peek only, without recovering claims or
+// removing partial writes, so the queue can be inspected while in use
+func openFileQueueReader(params FileQueueParams) (Reader, error) {
+	if _, err := os.Stat(params.Path); err != nil {
+		return nil, errors.Wrap(err, "failed to open queue directory")
+	}
+
+	entityRegex, err := regexp.Compile(identifierRegex)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileQueue{
+		name:        params.Name,
+		path:        params.Path,
+		dlqPath:     params.DlqPath,
+		entityRegex: entityRegex,
+	}, nil
 }
 
 func (s *fileQueue) Start() error {
 	go s.perform()
 
+	if s.visibilityTimeout > 0 {
+		go s.expireClaims()
+	}
+
 	return nil
 }
 
@@ -130,14 +238,156 @@ func (s *fileQueue) GetChannel() chan types.Message {
 }
 
 func (s *fileQueue) Put(message types.Message, priority int) error {
-	atomic.AddUint64(&s.messageCounter, 1)
+	return s.PutAt(message, priority, time.Now())
+}
+
+// The not before time replaces the put timestamp in the file name, so delayed
+// messages sort behind ready ones of the same priority.
+func (s *fileQueue) PutAt(message types.Message, priority int, notBefore time.Time) error {
+	if _, err := types.GetMessageTypeInfo(message.MessageType); err != nil {
+		return errors.Wrap(err, "refusing to queue message")
+	}
+
+	if s.maxAttempts > 0 && message.Attempts >= s.maxAttempts {
+		return s.putDeadLetter(message, priority, notBefore)
+	}
+
+	reserved, err := s.reserve()
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.writeMessage(s.path, message, priority, notBefore); err != nil {
+		if reserved {
+			s.release(1)
+		}
+
+		return err
+	}
+
+	if reserved {
+		return nil
+	}
+
+	// Spill policy, the queue may now be over capacity
+	atomic.AddInt64(&s.size, 1)
+
+	return s.spill()
+}
+
+func (s *fileQueue) Full() bool {
+	return s.maxSize > 0 && atomic.LoadInt64(&s.size) >= int64(s.maxSize)
+}
+
+// Claims a slot in the queue according to the overflow policy. Returns false
+// without error when the spill policy allows writing past capacity.
+func (s *fileQueue) reserve() (bool, error) {
+	if s.tryReserve() {
+		return true, nil
+	}
+
+	switch s.overflow {
+	case overflowReject:
+		return false, ErrQueueFull
+	case overflowSpill:
+		return false, nil
+	}
+
+	var deadline <-chan time.Time
+
+	if s.blockTimeout > 0 {
+		deadline = time.After(s.blockTimeout)
+	}
+
+	for !s.tryReserve() {
+		select {
+		case <-s.space:
+		case <-time.After(overflowPollDelay):
+		case <-deadline:
+			return false, ErrQueueFull
+		}
+	}
+
+	return true, nil
+}
+
+func (s *fileQueue) tryReserve() bool {
+	for {
+		size := atomic.LoadInt64(&s.size)
+
+		if s.maxSize > 0 && size >= int64(s.maxSize) {
+			return false
+		}
+
+		if atomic.CompareAndSwapInt64(&s.size, size, size+1) {
+			return true
+		}
+	}
+}
+
+func (s *fileQueue) release(n int64) {
+	atomic.AddInt64(&s.size, -n)
+
+	select {
+	case s.space <- true:
+	default:
+	}
+}
+
+// Moves the lowest priority messages into the DLQ until the queue is within capacity
+func (s *fileQueue) spill() error {
+	files, err := util.ReadDirAlphabetized(s.path)
+
+	if err != nil {
+		return errors.Wrap(err, "failed to read queue directory for spill")
+	}
+
+	for i := len(files) - 1; i >= 0 && atomic.LoadInt64(&s.size) > int64(s.maxSize); i-- {
+		name := files[i].Name()
+
+		if !s.entityRegex.MatchString(name) {
+			continue
+		}
+
+		// Message was claimed by a consumer in the meantime
+		if err := s.deadLetter(filepath.Join(s.path, name), name, "spilled from full queue", 0); os.IsNotExist(errors.Cause(err)) {
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *fileQueue) putDeadLetter(message types.Message, priority int, notBefore time.Time) error {
+	fileName, err := s.writeMessage(s.dlqPath, message, priority, notBefore)
 
-	timestamp := time.Now().Unix()
-	fileName := fmt.Sprintf("%d-%d-%d-%s", priority, timestamp, s.messageCounter, s.name)
-	finalPath := filepath.Join(s.path, fileName)
-	writingPath := fmt.Sprintf("%s%s", finalPath, writingSuffix)
+	if err != nil {
+		return err
+	}
+
+	reason := fmt.Sprintf("exceeded max attempts (%d)", s.maxAttempts)
+
+	return s.writeDeadLetterReason(fileName, reason, message.Attempts)
+}
+
+func (s *fileQueue) writeMessage(dir string, message types.Message, priority int, notBefore time.Time) (string, error) {
+	counter := atomic.AddUint64(&s.messageCounter, 1)
+	timestamp := notBefore.Unix()
+	fileName := fmt.Sprintf("%d-%d-%d-%s", priority, timestamp, counter, s.name)
+	finalPath := filepath.Join(dir, fileName)
 	message.ID = fileName
-	payload, err := json.Marshal(message)
+
+	return fileName, writeMessageFile(finalPath, message)
+}
+
+// Writes a message aside and renames it into place, so a message file is
+// never seen half written
+func writeMessageFile(path string, message types.Message) error {
+	writingPath := fmt.Sprintf("%s%s", path, writingSuffix)
+	payload, err := codec.Marshal(message)
 
 	if err != nil {
 		return err
@@ -150,6 +400,7 @@ func (s *fileQueue) Put(message types.Message, priority int) error {
 	}
 
 	if _, err = f.Write(payload); err != nil {
+		f.Close()
 		return errors.Wrap(err, "failed to write payload for queue put")
 	}
 
@@ -157,13 +408,12 @@ func (s *fileQueue) Put(message types.Message, priority int) error {
 		return errors.Wrap(err, "failed to close file for queue put")
 	}
 
-	if os.Rename(writingPath, finalPath); err != nil {
-		return errors.Wrap(err, "failed to rename file for queue put")
-	}
-
-	return nil
+	return errors.Wrap(os.Rename(writingPath, path), "failed to rename file for queue put")
 }
 
+// Returns messages claimed by a previous process to the queue when reset is
+// set. The claim never ended, so it counts as a failed attempt and a message
+// that keeps bringing the process down is dead lettered.
 func (s *fileQueue) Prepare() error {
 	if !s.reset {
 		return nil
@@ -182,25 +432,281 @@ func (s *fileQueue) Prepare() error {
 			continue
 		}
 
-		oldPath := filepath.Join(s.path, oldName)
-		newPath := filepath.Join(s.path, strings.TrimSuffix(oldName, claimedSuffix))
+		id := strings.TrimSuffix(oldName, claimedSuffix)
+		s.untrackClaim(id)
 
-		if err := os.Rename(oldPath, newPath); err != nil {
-			return errors.Wrap(err, "failed to rename file for queue prepare")
+		if err := s.failClaimed(id); err != nil {
+			return errors.Wrap(err, "failed to return claimed message for queue prepare")
 		}
 	}
 
 	return nil
 }
 
+// Does nothing but warn when the claim the message was delivered under has
+// expired, the message was returned to the queue and may be claimed again
 func (s *fileQueue) EndTransaction(message types.Message, success bool) error {
+	if !s.endClaim(message.ID, message.Claim) {
+		log.Warnf("queue %s ignoring late acknowledgement of message %s, its claim expired", s.name, message.ID)
+		instrument.GetMetrics().IncrCounter([]string{"queue", s.name, "claim", "late"}, 1)
+
+		return nil
+	}
+
 	messagePath := filepath.Join(s.path, message.ID) + claimedSuffix
 
 	if success {
-		return os.Remove(messagePath)
+		if err := os.Remove(messagePath); err != nil {
+			return err
+		}
+
+		s.release(1)
+
+		return nil
 	}
 
-	return os.Rename(messagePath, filepath.Join(s.path, message.ID))
+	return s.failClaimed(message.ID)
+}
+
+// Returns a claimed message to the queue as a failed attempt, or moves it to
+// the DLQ once it is out of attempts
+func (s *fileQueue) failClaimed(id string) error {
+	messagePath := filepath.Join(s.path, id) + claimedSuffix
+	message, err := s.getFileMessage(messagePath)
+
+	if err != nil {
+		return s.deadLetter(messagePath, id, err.Error(), 0)
+	}
+
+	message.Attempts += 1
+
+	if err := writeMessageFile(messagePath, *message); err != nil {
+		return err
+	}
+
+	if s.maxAttempts > 0 && message.Attempts >= s.maxAttempts {
+		reason := fmt.Sprintf("exceeded max attempts (%d)", s.maxAttempts)
+
+		return s.deadLetter(messagePath, id, reason, message.Attempts)
+	}
+
+	return os.Rename(messagePath, filepath.Join(s.path, id))
+}
+
+// Returns a claimed message that was never handed to a consumer
+func (s *fileQueue) unclaim(id string) {
+	s.untrackClaim(id)
+
+	if err := os.Rename(filepath.Join(s.path, id)+claimedSuffix, filepath.Join(s.path, id)); err != nil {
+		log.Errorf("Queue %s failed to unclaim message %s: %s", s.name, id, err)
+	}
+}
+
+// Moves dead letters back into the queue with their attempts starting over,
+// until the queue is full. Files that can not be decoded are left in the DLQ.
+func (s *fileQueue) RequeueDeadLetters() (int, error) {
+	files, err := ioutil.ReadDir(s.dlqPath)
+
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read dead letter directory")
+	}
+
+	count := 0
+
+	for _, file := range files {
+		name := file.Name()
+
+		if !s.entityRegex.MatchString(name) {
+			continue
+		}
+
+		oldPath := filepath.Join(s.dlqPath, name)
+		message, err := s.getFileMessage(oldPath)
+
+		if err != nil {
+			log.Errorf("queue %s can not requeue unreadable dead letter %s: %s", s.name, name, err)
+			continue
+		}
+
+		if !s.tryReserve() {
+			return count, ErrQueueFull
+		}
+
+		message.Attempts = 0
+
+		if err := writeMessageFile(filepath.Join(s.path, name), *message); err != nil {
+			s.release(1)
+			return count, errors.Wrap(err, "failed to requeue dead letter")
+		}
+
+		if err := os.Remove(oldPath); err != nil {
+			return count, errors.Wrap(err, "failed to remove requeued dead letter")
+		}
+
+		reasonPath := oldPath + deadLetterReasonSuffix
+
+		if err := os.Remove(reasonPath); err != nil && !os.IsNotExist(err) {
+			log.Errorf("failed to remove dead letter reason: %s", reasonPath)
+		}
+
+		count += 1
+	}
+
+	return count, nil
+}
+
+func (s *fileQueue) MoveDeadLetters(to Queue, priority int, limit int) (int, error) {
+	return moveDeadLetters(s.dlqPath, to, priority, limit)
+}
+
+// Puts dead letters into another queue in name order, removing each once the
+// queue accepts it. Attempts start over, files that can not be decoded are
+// left in place.
+func moveDeadLetters(dlqPath string, to Queue, priority int, limit int) (int, error) {
+	files, err := util.ReadDirAlphabetized(dlqPath)
+
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read dead letter directory")
+	}
+
+	count := 0
+
+	for _, file := range files {
+		name := file.Name()
+
+		if limit > 0 && count >= limit {
+			break
+		} else if strings.HasSuffix(name, deadLetterReasonSuffix) || strings.HasSuffix(name, writingSuffix) {
+			continue
+		}
+
+		path := filepath.Join(dlqPath, name)
+		contents, err := os.ReadFile(path)
+
+		if err != nil {
+			return count, errors.Wrap(err, "failed to read dead letter")
+		}
+
+		message := types.Message{}
+
+		if err := codec.Unmarshal(contents, &message); err != nil {
+			log.Errorf("skipping unreadable dead letter %s: %s", name, err)
+			continue
+		}
+
+		message.Attempts = 0
+
+		if err := to.Put(message, priority); err != nil {
+			return count, errors.Wrapf(err, "failed to move dead letter %s", name)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return count, errors.Wrap(err, "failed to remove moved dead letter")
+		}
+
+		if err := os.Remove(path + deadLetterReasonSuffix); err != nil && !os.IsNotExist(err) {
+			log.Errorf("failed to remove dead letter reason: %s", path+deadLetterReasonSuffix)
+		}
+
+		count += 1
+	}
+
+	return count, nil
+}
+
+func (s *fileQueue) Peek(limit int) ([]types.Message, error) {
+	files, err := util.ReadDirAlphabetized(s.path)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read queue directory for peek")
+	}
+
+	var messages []types.Message
+
+	for _, file := range files {
+		if limit > 0 && len(messages) >= limit {
+			break
+		}
+
+		if !s.entityRegex.MatchString(file.Name()) {
+			continue
+		}
+
+		// Messages claimed since the directory was read are skipped
+		if message, err := s.getFileMessage(filepath.Join(s.path, file.Name())); err == nil {
+			messages = append(messages, *message)
+		}
+	}
+
+	return messages, nil
+}
+
+// Removes unclaimed messages, messages being processed are left alone
+func (s *fileQueue) Purge() (int, error) {
+	files, err := ioutil.ReadDir(s.path)
+
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read queue directory for purge")
+	}
+
+	count := 0
+
+	for _, file := range files {
+		name := file.Name()
+
+		if !s.entityRegex.MatchString(name) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(s.path, name)); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			s.release(int64(count))
+			return count, errors.Wrap(err, "failed to purge message")
+		}
+
+		count += 1
+	}
+
+	s.release(int64(count))
+
+	return count, nil
+}
+
+func (s *fileQueue) deadLetter(path string, id string, reason string, attempts int) error {
+	if err := os.Rename(path, filepath.Join(s.dlqPath, id)); err != nil {
+		return errors.Wrap(err, "failed to move message to dead letter queue")
+	}
+
+	s.release(1)
+
+	return s.writeDeadLetterReason(id, reason, attempts)
+}
+
+func (s *fileQueue) writeDeadLetterReason(id string, reason string, attempts int) error {
+	return writeDeadLetterReason(s.name, s.dlqPath, id, reason, attempts)
+}
+
+// Records why a message was dead lettered next to it in the DLQ directory
+func writeDeadLetterReason(queueName, dlqPath, id, reason string, attempts int) error {
+	reasonPath := filepath.Join(dlqPath, id) + deadLetterReasonSuffix
+	payload, err := json.Marshal(deadLetterReason{
+		Reason:    reason,
+		Attempts:  attempts,
+		Timestamp: time.Now().Unix(),
+	})
+
+	if err != nil {
+		return errors.Wrap(err, "failed to serialize dead letter reason")
+	}
+
+	if err := os.WriteFile(reasonPath, payload, 0644); err != nil {
+		return errors.Wrap(err, "failed to write dead letter reason")
+	}
+
+	log.Errorf("queue %s moved message %s to dead letter queue: %s", queueName, id, reason)
+
+	return nil
 }
 
 func (s *fileQueue) Len() int64 {
@@ -238,7 +744,13 @@ func (s *fileQueue) perform() {
 			} else if message == nil {
 				log.Errorf("Queue %s got nil message", s.name)
 			} else {
-				s.channel <- *message
+				select {
+				case s.channel <- *message:
+				case <-s.terminate:
+					s.unclaim(message.ID)
+					s.terminated <- true
+					return
+				}
 			}
 		case <-s.terminate:
 			s.terminated <- true
@@ -255,19 +767,35 @@ func (s *fileQueue) next() (*types.Message, error) {
 		return nil, err
 	}
 
+	now := time.Now().Unix()
+
 	for _, file := range files {
 		name := file.Name()
 
-		if !s.entityRegex.MatchString(name) {
+		if !s.entityRegex.MatchString(name) || getNotBefore(name) > now {
 			continue
 		}
 
 		workFile := filepath.Join(s.path, name)
 		claimedPath, err := s.claimFile(workFile)
 
+		if err != nil {
+			continue
+		}
+
+		message, err := s.getFileMessage(claimedPath)
+
 		if err == nil {
-			return s.getFileMessage(claimedPath)
+			message.Claim = s.trackClaim(name, time.Now())
+			return message, nil
+		}
+
+		// Unparseable messages will never succeed, skip retries
+		if dlqErr := s.deadLetter(claimedPath, name, err.Error(), 1); dlqErr != nil {
+			log.Error(dlqErr)
 		}
+
+		return nil, err
 	}
 
 	return nil, errQueueEmpty
@@ -287,7 +815,149 @@ func (s *fileQueue) getFileMessage(path string) (*types.Message, error) {
 	}
 
 	message := types.Message{}
-	err = json.Unmarshal(contents, &message)
 
-	return &message, errors.Wrap(err, "error while parsing message json")
+	if err = codec.Unmarshal(contents, &message); err != nil {
+		return &message, errors.Wrap(err, "error while parsing message")
+	}
+
+	_, err = types.GetMessageTypeInfo(message.MessageType)
+
+	return &message, err
+}
+
+// Removes partially written messages left behind by a crash and starts the
+// visibility clock on messages claimed by a previous process.
+func (s *fileQueue) recoverFiles() error {
+	files, err := ioutil.ReadDir(s.path)
+
+	if err != nil {
+		return errors.Wrap(err, "failed to read queue directory for recovery")
+	}
+
+	now := time.Now()
+	swept := 0
+
+	for _, file := range files {
+		name := file.Name()
+
+		if strings.HasSuffix(name, claimedSuffix) {
+			s.trackClaim(strings.TrimSuffix(name, claimedSuffix), now)
+			continue
+		}
+
+		if !strings.HasSuffix(name, writingSuffix) || now.Sub(file.ModTime()) < staleWritingAge {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(s.path, name)); err != nil {
+			log.Errorf("failed to remove stale queue file %s: %s", name, err)
+			continue
+		}
+
+		swept += 1
+	}
+
+	if swept > 0 {
+		log.Infof("queue %s removed %d stale partial writes", s.name, swept)
+		instrument.GetMetrics().IncrCounter([]string{"queue", s.name, "writing", "swept"}, float32(swept))
+	}
+
+	return nil
+}
+
+func (s *fileQueue) expireClaims() {
+	for !s.isTerminating() {
+		time.Sleep(s.visibilityTimeout / 2)
+
+		for _, id := range s.getExpiredClaims() {
+			log.Errorf("queue %s claim expired for message %s", s.name, id)
+			instrument.GetMetrics().IncrCounter([]string{"queue", s.name, "claim", "expired"}, 1)
+
+			// Counts as a failed attempt, hanging messages eventually reach the DLQ
+			if err := s.failClaimed(id); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+func (s *fileQueue) getExpiredClaims() (expired []string) {
+	s.claimsLock.Lock()
+	defer s.claimsLock.Unlock()
+
+	now := time.Now()
+
+	for id, claim := range s.claims {
+		if now.Sub(claim.at) >= s.visibilityTimeout {
+			expired = append(expired, id)
+			delete(s.claims, id)
+		}
+	}
+
+	return
+}
+
+func (s *fileQueue) trackClaim(id string, when time.Time) uint64 {
+	s.claimsLock.Lock()
+	defer s.claimsLock.Unlock()
+
+	s.claimCounter += 1
+	s.claims[id] = fileClaim{token: s.claimCounter, at: when}
+
+	return s.claimCounter
+}
+
+// Stops tracking the claim if it is still held under the token
+func (s *fileQueue) endClaim(id string, token uint64) bool {
+	s.claimsLock.Lock()
+	defer s.claimsLock.Unlock()
+
+	if claim, ok := s.claims[id]; !ok || claim.token != token {
+		return false
+	}
+
+	delete(s.claims, id)
+
+	return true
+}
+
+func (s *fileQueue) untrackClaim(id string) {
+	s.claimsLock.Lock()
+	defer s.claimsLock.Unlock()
+
+	delete(s.claims, id)
+}
+
+func getNotBefore(name string) int64 {
+	tokens := strings.SplitN(name, "-", 3)
+
+	if len(tokens) < 3 {
+		return 0
+	}
+
+	timestamp, err := strconv.ParseInt(tokens[1], 10, 64)
+
+	if err != nil {
+		return 0
+	}
+
+	return timestamp
+}
+
+func countQueueEntities(path string, entityRegex *regexp.Regexp) (int64, error) {
+	files, err := ioutil.ReadDir(path)
+
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read queue directory")
+	}
+
+	var count int64
+
+	for _, file := range files {
+		if entityRegex.MatchString(strings.TrimSuffix(file.Name(), claimedSuffix)) {
+			count += 1
+		}
+	}
+
+	return count, nil
 }
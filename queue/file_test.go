@@ -0,0 +1,479 @@
+package queue
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iakinsey/delver/codec"
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/types"
+	"github.com/iakinsey/delver/util"
+)
+
+func newTestFileQueue(maxAttempts int) (*fileQueue, string, string) {
+	return newTestFileQueueWithParams(FileQueueParams{MaxAttempts: maxAttempts})
+}
+
+func newTestFileQueueWithParams(params FileQueueParams) (*fileQueue, string, string) {
+	params.Name = "TestFileQueue"
+	params.Path = util.MakeTempFolder("TestFileQueue")
+	params.DlqPath = util.MakeTempFolder("TestFileQueueDLQ")
+	params.MaxPollDelayMs = 100
+	q := NewFileQueue(params)
+
+	return q.(*fileQueue), params.Path, params.DlqPath
+}
+
+func assertDirSize(t *testing.T, path string, length int) {
+	files, err := os.ReadDir(path)
+
+	assert.NoError(t, err)
+	assert.Len(t, files, length)
+}
+
+func TestFileQueueDeadLetter(t *testing.T) {
+	q, path, dlqPath := newTestFileQueue(2)
+
+	defer os.RemoveAll(path)
+	defer os.RemoveAll(dlqPath)
+
+	msg, err := types.NewMessage("test", types.FetcherRequestType)
+
+	assert.NoError(t, err)
+	assert.NoError(t, q.Put(msg, 0))
+
+	claimed, err := q.next()
+
+	assert.NoError(t, err)
+	assert.NoError(t, q.EndTransaction(*claimed, false))
+	assertDirSize(t, path, 1)
+	assertDirSize(t, dlqPath, 0)
+
+	claimed, err = q.next()
+
+	assert.NoError(t, err)
+	assert.NoError(t, q.EndTransaction(*claimed, false))
+	assertDirSize(t, path, 0)
+	assertDirSize(t, dlqPath, 2)
+
+	b, err := os.ReadFile(filepath.Join(dlqPath, claimed.ID+deadLetterReasonSuffix))
+	reason := deadLetterReason{}
+
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(b, &reason))
+	assert.Equal(t, 2, reason.Attempts)
+
+	count, err := q.RequeueDeadLetters()
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assertDirSize(t, dlqPath, 0)
+
+	claimed, err = q.next()
+
+	assert.NoError(t, err)
+	assert.Equal(t, msg.Message, claimed.Message)
+	assert.Equal(t, 0, claimed.Attempts)
+	assert.NoError(t, q.EndTransaction(*claimed, true))
+	assertDirSize(t, path, 0)
+}
+
+// Claims left behind by a process that went down count as failed attempts
+// when the next process resets them
+func TestFileQueueDeadLetterAfterCrash(t *testing.T) {
+	params := FileQueueParams{MaxAttempts: 2, Reset: true}
+	q, path, dlqPath := newTestFileQueueWithParams(params)
+
+	defer os.RemoveAll(path)
+	defer os.RemoveAll(dlqPath)
+
+	params.Name, params.Path, params.DlqPath, params.MaxPollDelayMs = q.name, path, dlqPath, 100
+	msg, _ := types.NewMessage("poison", types.FetcherRequestType)
+
+	assert.NoError(t, q.Put(msg, 0))
+
+	claimed, err := q.next()
+
+	assert.NoError(t, err)
+
+	q = NewFileQueue(params).(*fileQueue)
+
+	assert.NoError(t, q.Prepare())
+
+	claimed, err = q.next()
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, claimed.Attempts)
+
+	q = NewFileQueue(params).(*fileQueue)
+
+	assert.NoError(t, q.Prepare())
+	assertDirSize(t, path, 0)
+	assertDirSize(t, dlqPath, 2)
+}
+
+func TestFileQueueRequeueFull(t *testing.T) {
+	q, path, dlqPath := newTestFileQueueWithParams(FileQueueParams{MaxAttempts: 1, MaxSize: 1})
+
+	defer os.RemoveAll(path)
+	defer os.RemoveAll(dlqPath)
+
+	msg, _ := types.NewMessage("test", types.FetcherRequestType)
+
+	assert.NoError(t, q.Put(msg, 0))
+
+	claimed, err := q.next()
+
+	assert.NoError(t, err)
+	assert.NoError(t, q.EndTransaction(*claimed, false))
+	assert.NoError(t, q.Put(msg, 0))
+
+	count, err := q.RequeueDeadLetters()
+
+	assert.ErrorIs(t, err, ErrQueueFull)
+	assert.Equal(t, 0, count)
+	assertDirSize(t, path, 1)
+	assertDirSize(t, dlqPath, 2)
+}
+
+func TestFileQueuePersistsHeaders(t *testing.T) {
+	q, path, dlqPath := newTestFileQueue(0)
+
+	defer os.RemoveAll(path)
+	defer os.RemoveAll(dlqPath)
+
+	msg, _ := types.NewMessage("test", types.FetcherRequestType)
+	msg.Headers = types.Headers{
+		TraceID:   "trace",
+		Seed:      "http://example.com",
+		CreatedAt: 1,
+		Hops:      2,
+		Producer:  "producer",
+		User:      map[string]string{"key": "value"},
+	}
+
+	assert.NoError(t, q.Put(msg, 0))
+
+	claimed, err := q.next()
+
+	assert.NoError(t, err)
+	assert.Equal(t, msg.Headers, claimed.Headers)
+}
+
+func TestFileQueueDeadLetterMalformed(t *testing.T) {
+	q, path, dlqPath := newTestFileQueue(0)
+
+	defer os.RemoveAll(path)
+	defer os.RemoveAll(dlqPath)
+
+	name := "0-0-1-TestFileQueue"
+
+	assert.NoError(t, os.WriteFile(filepath.Join(path, name), []byte("{not json"), 0644))
+
+	_, err := q.next()
+
+	assert.Error(t, err)
+	assertDirSize(t, path, 0)
+	assertDirSize(t, dlqPath, 2)
+
+	_, err = q.next()
+
+	assert.Equal(t, errQueueEmpty, err)
+}
+
+func TestFileQueueOverflowReject(t *testing.T) {
+	q, path, dlqPath := newTestFileQueueWithParams(FileQueueParams{
+		MaxSize:        2,
+		OverflowPolicy: overflowReject,
+	})
+
+	defer os.RemoveAll(path)
+	defer os.RemoveAll(dlqPath)
+
+	msg, _ := types.NewMessage("test", types.FetcherRequestType)
+
+	assert.NoError(t, q.Put(msg, 0))
+	assert.False(t, q.Full())
+	assert.NoError(t, q.Put(msg, 0))
+	assert.True(t, q.Full())
+	assert.Equal(t, ErrQueueFull, q.Put(msg, 0))
+	assertDirSize(t, path, 2)
+
+	claimed, err := q.next()
+
+	assert.NoError(t, err)
+	assert.True(t, q.Full())
+	assert.NoError(t, q.EndTransaction(*claimed, true))
+	assert.False(t, q.Full())
+	assert.NoError(t, q.Put(msg, 0))
+}
+
+func TestFileQueueOverflowBlock(t *testing.T) {
+	q, path, dlqPath := newTestFileQueueWithParams(FileQueueParams{
+		MaxSize:        1,
+		BlockTimeoutMs: 50,
+	})
+
+	defer os.RemoveAll(path)
+	defer os.RemoveAll(dlqPath)
+
+	msg, _ := types.NewMessage("test", types.FetcherRequestType)
+
+	assert.NoError(t, q.Put(msg, 0))
+	assert.Equal(t, ErrQueueFull, q.Put(msg, 0))
+
+	claimed, err := q.next()
+
+	assert.NoError(t, err)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.EndTransaction(*claimed, true)
+	}()
+
+	assert.NoError(t, q.Put(msg, 0))
+	assertDirSize(t, path, 1)
+}
+
+func TestFileQueueOverflowSpill(t *testing.T) {
+	q, path, dlqPath := newTestFileQueueWithParams(FileQueueParams{
+		MaxSize:        2,
+		OverflowPolicy: overflowSpill,
+	})
+
+	defer os.RemoveAll(path)
+	defer os.RemoveAll(dlqPath)
+
+	msg, _ := types.NewMessage("test", types.FetcherRequestType)
+
+	assert.NoError(t, q.Put(msg, 1))
+	assert.NoError(t, q.Put(msg, 3))
+	assert.NoError(t, q.Put(msg, 2))
+	assertDirSize(t, path, 2)
+	assertDirSize(t, dlqPath, 2)
+
+	files, err := os.ReadDir(dlqPath)
+
+	assert.NoError(t, err)
+	assert.Regexp(t, "^3-", files[0].Name())
+}
+
+func TestFileQueueVisibilityTimeout(t *testing.T) {
+	q, path, dlqPath := newTestFileQueueWithParams(FileQueueParams{
+		VisibilityTimeoutMs: 20,
+	})
+
+	defer os.RemoveAll(path)
+	defer os.RemoveAll(dlqPath)
+
+	msg, _ := types.NewMessage("test", types.FetcherRequestType)
+
+	assert.NoError(t, q.Put(msg, 0))
+	assert.NoError(t, q.Start())
+
+	claimed := <-q.GetChannel()
+	redelivered := <-q.GetChannel()
+
+	assert.Equal(t, claimed.ID, redelivered.ID)
+	assert.NoError(t, q.EndTransaction(redelivered, true))
+	assert.NoError(t, q.Stop())
+	assertDirSize(t, path, 0)
+}
+
+func TestFileQueueLateAcknowledgement(t *testing.T) {
+	q, path, dlqPath := newTestFileQueueWithParams(FileQueueParams{
+		VisibilityTimeoutMs: 100,
+	})
+
+	defer os.RemoveAll(path)
+	defer os.RemoveAll(dlqPath)
+
+	msg, _ := types.NewMessage("test", types.FetcherRequestType)
+
+	assert.NoError(t, q.Put(msg, 0))
+	assert.NoError(t, q.Start())
+
+	expired := <-q.GetChannel()
+	redelivered := <-q.GetChannel()
+
+	assert.NotEqual(t, expired.Claim, redelivered.Claim)
+
+	// The first consumer finishing late leaves the new claim alone
+	assert.NoError(t, q.EndTransaction(expired, true))
+	assert.Equal(t, int64(1), q.size)
+	assertDirSize(t, path, 1)
+
+	assert.NoError(t, q.EndTransaction(redelivered, true))
+	assert.NoError(t, q.Stop())
+	assert.Equal(t, int64(0), q.size)
+	assertDirSize(t, path, 0)
+}
+
+func TestFileQueueRecovery(t *testing.T) {
+	path := util.MakeTempFolder("TestFileQueue")
+	dlqPath := util.MakeTempFolder("TestFileQueueDLQ")
+
+	defer os.RemoveAll(path)
+	defer os.RemoveAll(dlqPath)
+
+	stale := filepath.Join(path, "0-0-1-TestFileQueue"+writingSuffix)
+	fresh := filepath.Join(path, "0-0-2-TestFileQueue"+writingSuffix)
+	orphan := filepath.Join(path, "0-0-3-TestFileQueue"+claimedSuffix)
+	old := time.Now().Add(-2 * staleWritingAge)
+
+	assert.NoError(t, os.WriteFile(stale, []byte("{"), 0644))
+	assert.NoError(t, os.WriteFile(fresh, []byte("{"), 0644))
+	assert.NoError(t, os.WriteFile(orphan, []byte("{}"), 0644))
+	assert.NoError(t, os.Chtimes(stale, old, old))
+
+	q := NewFileQueue(FileQueueParams{
+		Name:                "TestFileQueue",
+		Path:                path,
+		DlqPath:             dlqPath,
+		MaxPollDelayMs:      100,
+		VisibilityTimeoutMs: 1000,
+	}).(*fileQueue)
+
+	assertDirSize(t, path, 2)
+	assert.Contains(t, q.claims, "0-0-3-TestFileQueue")
+}
+
+func TestFileQueuePutAt(t *testing.T) {
+	q, path, dlqPath := newTestFileQueue(0)
+
+	defer os.RemoveAll(path)
+	defer os.RemoveAll(dlqPath)
+
+	delayed, _ := types.NewMessage("delayed", types.FetcherRequestType)
+	ready, _ := types.NewMessage("ready", types.FetcherRequestType)
+
+	assert.NoError(t, q.PutAt(delayed, 0, time.Now().Add(time.Hour)))
+	assert.NoError(t, q.Put(ready, 5))
+
+	claimed, err := q.next()
+
+	assert.NoError(t, err)
+	assert.Equal(t, ready.Message, claimed.Message)
+	assert.NoError(t, q.EndTransaction(*claimed, true))
+
+	_, err = q.next()
+
+	assert.Equal(t, errQueueEmpty, err)
+	assertDirSize(t, path, 1)
+}
+
+func TestFileQueuePeekPurge(t *testing.T) {
+	q, path, dlqPath := newTestFileQueue(0)
+
+	defer os.RemoveAll(path)
+	defer os.RemoveAll(dlqPath)
+
+	for i, priority := range []int{2, 1, 3} {
+		msg, _ := types.NewMessage(i, types.FetcherRequestType)
+		assert.NoError(t, q.Put(msg, priority))
+	}
+
+	claimed, err := q.next()
+
+	assert.NoError(t, err)
+
+	messages, err := q.Peek(0)
+
+	assert.NoError(t, err)
+	assert.Len(t, messages, 2)
+	assert.Equal(t, "0", string(messages[0].Message))
+	assertDirSize(t, path, 3)
+
+	count, err := q.Purge()
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, int64(1), q.Len())
+	assert.NoError(t, q.EndTransaction(*claimed, true))
+	assertDirSize(t, path, 0)
+}
+
+func TestFileQueueMixedCodecs(t *testing.T) {
+	q, path, dlqPath := newTestFileQueue(0)
+
+	defer os.RemoveAll(path)
+	defer os.RemoveAll(dlqPath)
+	defer config.Set(json.RawMessage(`{}`))
+
+	legacy, _ := types.NewMessage("legacy", types.FetcherRequestType)
+
+	assert.NoError(t, q.Put(legacy, 0))
+
+	config.Set(json.RawMessage(`{"codec": {"format": "msgpack", "compression": "zstd"}}`))
+
+	payload, err := codec.MarshalPayload("binary")
+
+	assert.NoError(t, err)
+	assert.NoError(t, q.Put(types.Message{MessageType: types.FetcherRequestType, Message: payload}, 1))
+
+	for _, expected := range []string{"legacy", "binary"} {
+		var value string
+
+		claimed, err := q.next()
+
+		assert.NoError(t, err)
+		assert.NoError(t, codec.Unmarshal(claimed.Message, &value))
+		assert.Equal(t, expected, value)
+	}
+}
+
+func TestFileQueueUnknownMessageType(t *testing.T) {
+	q, path, dlqPath := newTestFileQueue(0)
+
+	defer os.RemoveAll(path)
+	defer os.RemoveAll(dlqPath)
+
+	err := q.Put(types.Message{MessageType: types.MessageType(1000)}, 0)
+
+	assert.True(t, errors.Is(err, types.ErrUnknownMessageType))
+	assertDirSize(t, path, 0)
+
+	name := "0-0-1-TestFileQueue"
+	contents := []byte(`{"id": "0", "message_type": 1000}`)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(path, name), contents, 0644))
+
+	_, err = q.next()
+
+	assert.True(t, errors.Is(err, types.ErrUnknownMessageType))
+	assertDirSize(t, dlqPath, 2)
+}
+
+func TestFileQueueMoveDeadLetters(t *testing.T) {
+	q, path, dlqPath := newTestFileQueue(1)
+	to, toPath, toDlqPath := newTestFileQueue(0)
+
+	defer os.RemoveAll(path)
+	defer os.RemoveAll(dlqPath)
+	defer os.RemoveAll(toPath)
+	defer os.RemoveAll(toDlqPath)
+
+	msg, _ := types.NewMessage("test", types.FetcherRequestType)
+	msg.Attempts = 3
+
+	assert.NoError(t, q.Put(msg, 0))
+	assertDirSize(t, dlqPath, 2)
+
+	count, err := q.MoveDeadLetters(to, 0, 0)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assertDirSize(t, dlqPath, 0)
+
+	moved, err := to.next()
+
+	assert.NoError(t, err)
+	assert.Equal(t, msg.Message, moved.Message)
+	assert.Equal(t, 0, moved.Attempts)
+}
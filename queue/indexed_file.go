@@ -0,0 +1,982 @@
+package queue
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iakinsey/delver/codec"
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/resource"
+	"github.com/iakinsey/delver/types"
+	"github.com/iakinsey/delver/util"
+)
+
+const segmentSuffix = ".segment"
+const indexedDlqDir = "dead_letters"
+const recordHeaderSize = 8
+const defaultSegmentSize = 64 * 1024 * 1024
+
+const (
+	recordPut = "put"
+	recordAck = "ack"
+	// Counts a delivery of a message, undone by a release if the message was
+	// taken back before reaching a consumer
+	recordDeliver = "deliver"
+	recordRelease = "release"
+)
+
+var errCorruptRecord = errors.New("corrupt segment record")
+
+type indexedRecord struct {
+	Op        string         `json:"op"`
+	Seq       uint64         `json:"seq"`
+	Priority  int            `json:"priority,omitempty"`
+	NotBefore int64          `json:"not_before,omitempty"`
+	Message   *types.Message `json:"message,omitempty"`
+}
+
+// Location of an unacknowledged message within the segment log
+type indexedEntry struct {
+	id        string
+	seq       uint64
+	priority  int
+	notBefore int64
+	segment   uint64
+	offset    int64
+	length    int64
+	// Deliveries not followed by an acknowledgement, replayed from the log
+	deliveries int
+}
+
+type indexedHeap []*indexedEntry
+
+func (h indexedHeap) Len() int {
+	return len(h)
+}
+
+func (h indexedHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *indexedHeap) Push(x interface{}) {
+	*h = append(*h, x.(*indexedEntry))
+}
+
+// Lower priorities are delivered first, matching fileQueue
+func (h indexedHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority < h[j].priority
+	}
+
+	return h[i].seq < h[j].seq
+}
+
+func (h *indexedHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	*h = old[:n-1]
+
+	return entry
+}
+
+// Messages waiting on their not before time, earliest first
+type indexedDelayHeap struct {
+	indexedHeap
+}
+
+func (h indexedDelayHeap) Less(i, j int) bool {
+	return h.indexedHeap[i].notBefore < h.indexedHeap[j].notBefore
+}
+
+type indexedFileQueue struct {
+	name        string
+	path        string
+	dlqPath     string
+	maxAttempts int
+	segmentSize int64
+	sync        bool
+	lock        sync.Mutex
+	index       indexedHeap
+	delayed     indexedDelayHeap
+	claimed     map[string]*indexedEntry
+	live        map[uint64]int
+	segments    []uint64
+	readers     map[uint64]*os.File
+	active      *os.File
+	activeID    uint64
+	activeSize  int64
+	seq         uint64
+	notify      chan bool
+	channel     chan types.Message
+	terminate   chan bool
+	terminated  chan bool
+}
+
+type IndexedFileQueueParams struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// Defaults to a dead_letters directory inside the queue path
+	DlqPath string `json:"dlq_path"`
+	// Deliveries before a message is dead lettered, 0 retries forever.
+	// Deliveries are recorded in the log, so a message that keeps crashing
+	// the process is dead lettered too. A message that keeps failing holds
+	// back compaction of every later segment until it is dead lettered.
+	MaxAttempts int   `json:"max_attempts"`
+	SegmentSize int64 `json:"segment_size"`
+	Sync        bool  `json:"sync"`
+}
+
+func init() {
+	resource.Register("indexed_file_queue", resource.Factory{
+		Params: func(_ config.Resource) interface{} { return &IndexedFileQueueParams{} },
+		New: func(params interface{}) interface{} {
+			return NewIndexedFileQueue(*params.(*IndexedFileQueueParams))
+		},
+		Type: reflect.TypeOf((*Queue)(nil)).Elem(),
+	})
+}
+
+func NewIndexedFileQueue(params IndexedFileQueueParams) Queue {
+	nameRegexp, err := regexp.Compile(nameRegex)
+
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	if !nameRegexp.MatchString(params.Name) {
+		log.Fatalf("Queue name %s does not conform to regex %s", params.Name, nameRegexp)
+	}
+
+	if err := util.GetOrCreateDir(params.Path); err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	dlqPath := params.DlqPath
+
+	if dlqPath == "" {
+		dlqPath = filepath.Join(params.Path, indexedDlqDir)
+	}
+
+	if err := util.GetOrCreateDir(dlqPath); err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	segmentSize := params.SegmentSize
+
+	if segmentSize <= 0 {
+		segmentSize = defaultSegmentSize
+	}
+
+	q := &indexedFileQueue{
+		name:        params.Name,
+		path:        params.Path,
+		dlqPath:     dlqPath,
+		maxAttempts: params.MaxAttempts,
+		segmentSize: segmentSize,
+		sync:        params.Sync,
+		notify:      make(chan bool, 1),
+		channel:     make(chan types.Message),
+		terminate:   make(chan bool),
+		terminated:  make(chan bool),
+	}
+
+	if err := q.Prepare(); err != nil {
+		log.Fatalf("failed to load indexed queue %s: %s", params.Name, err)
+	}
+
+	return q
+}
+
+func (s *indexedFileQueue) Start() error {
+	go s.perform()
+
+	return nil
+}
+
+func (s *indexedFileQueue) Stop() error {
+	s.terminate <- true
+	<-s.terminated
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.closeFiles()
+}
+
+func (s *indexedFileQueue) GetChannel() chan types.Message {
+	return s.channel
+}
+
+func (s *indexedFileQueue) Put(message types.Message, priority int) error {
+	return s.PutAt(message, priority, time.Now())
+}
+
+// Messages that already used up their attempts go straight to the DLQ
+func (s *indexedFileQueue) PutAt(message types.Message, priority int, notBefore time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, message, err := s.put(message, priority, notBefore)
+
+	if err != nil {
+		return err
+	}
+
+	if s.maxAttempts > 0 && message.Attempts >= s.maxAttempts {
+		return s.deadLetterMessage(entry, message, message.Attempts)
+	}
+
+	s.push(entry, time.Now().UnixMilli())
+	s.signal()
+
+	return nil
+}
+
+// Appends a message to the log without queueing it for delivery
+func (s *indexedFileQueue) put(message types.Message, priority int, notBefore time.Time) (*indexedEntry, types.Message, error) {
+	seq := s.seq
+	entry := &indexedEntry{
+		id:       s.getID(priority, seq),
+		seq:      seq,
+		priority: priority,
+	}
+
+	if time.Until(notBefore) > 0 {
+		entry.notBefore = notBefore.UnixMilli()
+	}
+
+	message.ID = entry.id
+	payload, err := codec.Marshal(indexedRecord{
+		Op:        recordPut,
+		Seq:       seq,
+		Priority:  priority,
+		NotBefore: entry.notBefore,
+		Message:   &message,
+	})
+
+	if err != nil {
+		return nil, message, errors.Wrap(err, "failed to serialize message for indexed queue put")
+	}
+
+	if entry.segment, entry.offset, err = s.append(payload); err != nil {
+		return nil, message, errors.Wrap(err, "failed to append message for indexed queue put")
+	}
+
+	entry.length = int64(len(payload))
+	s.seq += 1
+	s.live[entry.segment] += 1
+
+	return entry, message, nil
+}
+
+// Rebuilds the index from the segment log. Claimed but unacknowledged
+// messages are returned to the queue. Does nothing while the queue is
+// already prepared, so messages in flight keep their claims.
+func (s *indexedFileQueue) Prepare() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.active != nil {
+		return nil
+	}
+
+	if err := s.load(true); err != nil {
+		return err
+	}
+
+	if len(s.segments) > 0 {
+		s.activeID = s.segments[len(s.segments)-1] + 1
+	}
+
+	if err := s.openActive(); err != nil {
+		return err
+	}
+
+	return s.compact()
+}
+
+// Loads an indexed queue for Len and Peek only. Nothing is truncated,
+// compacted or created, so the queue can be inspected while in use.
+func openIndexedFileQueueReader(params IndexedFileQueueParams) (Reader, error) {
+	if _, err := os.Stat(params.Path); err != nil {
+		return nil, errors.Wrap(err, "failed to open indexed queue directory")
+	}
+
+	q := &indexedFileQueue{
+		name: params.Name,
+		path: params.Path,
+	}
+
+	return q, q.load(false)
+}
+
+// Replays the segment log into the index. A torn record at the end of the
+// log is truncated away when repair is set.
+func (s *indexedFileQueue) load(repair bool) error {
+	if err := s.closeFiles(); err != nil {
+		return err
+	}
+
+	segments, err := s.listSegments()
+
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[uint64]*indexedEntry)
+	s.seq = 0
+
+	for i, id := range segments {
+		if err := s.loadSegment(id, entries, repair && i == len(segments)-1); err != nil {
+			return err
+		}
+	}
+
+	s.index = make(indexedHeap, 0, len(entries))
+	s.delayed = indexedDelayHeap{}
+	s.claimed = make(map[string]*indexedEntry)
+	s.live = make(map[uint64]int)
+	s.segments = segments
+	s.readers = make(map[uint64]*os.File)
+
+	now := time.Now().UnixMilli()
+
+	for _, entry := range entries {
+		s.push(entry, now)
+		s.live[entry.segment] += 1
+	}
+
+	return nil
+}
+
+func (s *indexedFileQueue) EndTransaction(message types.Message, success bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, ok := s.claimed[message.ID]
+
+	if !ok {
+		return fmt.Errorf("no claimed message %s in indexed queue", message.ID)
+	}
+
+	delete(s.claimed, message.ID)
+
+	if success {
+		return s.ack(entry)
+	}
+
+	if s.exhausted(entry) {
+		return s.deadLetterMessage(entry, message, entry.deliveries)
+	}
+
+	heap.Push(&s.index, entry)
+	s.signal()
+
+	return nil
+}
+
+// Moves dead lettered messages back into the queue, files that can not be
+// decoded are left in the DLQ
+func (s *indexedFileQueue) RequeueDeadLetters() (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	files, err := ioutil.ReadDir(s.dlqPath)
+
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read dead letter directory")
+	}
+
+	count := 0
+	now := time.Now()
+
+	for _, file := range files {
+		name := file.Name()
+
+		if strings.HasSuffix(name, deadLetterReasonSuffix) {
+			continue
+		}
+
+		path := filepath.Join(s.dlqPath, name)
+		contents, err := os.ReadFile(path)
+
+		if err != nil {
+			return count, errors.Wrap(err, "failed to read dead letter")
+		}
+
+		message := types.Message{}
+
+		if err := codec.Unmarshal(contents, &message); err != nil {
+			log.Errorf("queue %s can not requeue unreadable dead letter %s: %s", s.name, name, err)
+			continue
+		}
+
+		entry, _, err := s.put(message, getIndexedPriority(name), now)
+
+		if err != nil {
+			return count, err
+		}
+
+		s.push(entry, now.UnixMilli())
+
+		if err := os.Remove(path); err != nil {
+			return count, errors.Wrap(err, "failed to remove requeued dead letter")
+		}
+
+		if err := os.Remove(path + deadLetterReasonSuffix); err != nil && !os.IsNotExist(err) {
+			log.Errorf("failed to remove dead letter reason: %s", path+deadLetterReasonSuffix)
+		}
+
+		count += 1
+	}
+
+	if count > 0 {
+		s.signal()
+	}
+
+	return count, nil
+}
+
+func (s *indexedFileQueue) Len() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return int64(len(s.index) + len(s.delayed.indexedHeap) + len(s.claimed))
+}
+
+func (s *indexedFileQueue) Peek(limit int) ([]types.Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	index := append(indexedHeap{}, s.index...)
+	delayed := append(indexedHeap{}, s.delayed.indexedHeap...)
+
+	sort.Sort(index)
+	sort.Sort(indexedDelayHeap{delayed})
+
+	var messages []types.Message
+
+	for _, entry := range append(index, delayed...) {
+		if limit > 0 && len(messages) >= limit {
+			break
+		}
+
+		record, err := s.readRecord(entry)
+
+		if err != nil {
+			return messages, err
+		} else if record.Message == nil {
+			return messages, errCorruptRecord
+		}
+
+		record.Message.ID = entry.id
+		messages = append(messages, *record.Message)
+	}
+
+	return messages, nil
+}
+
+// Acknowledges every unclaimed message, messages being processed are left alone
+func (s *indexedFileQueue) Purge() (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	count := 0
+
+	for _, h := range []*indexedHeap{&s.index, &s.delayed.indexedHeap} {
+		for len(*h) > 0 {
+			entry := (*h)[len(*h)-1]
+
+			if err := s.ack(entry); err != nil {
+				return count, err
+			}
+
+			*h = (*h)[:len(*h)-1]
+			count += 1
+		}
+	}
+
+	return count, nil
+}
+
+func (s *indexedFileQueue) perform() {
+	for {
+		message, err := s.next()
+
+		if err == errQueueEmpty {
+			select {
+			case <-s.notify:
+				continue
+			case <-s.nextDue():
+				continue
+			case <-s.terminate:
+				s.terminated <- true
+				return
+			}
+		} else if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		select {
+		case s.channel <- *message:
+		case <-s.terminate:
+			s.release(message.ID)
+			s.terminated <- true
+			return
+		}
+	}
+}
+
+func (s *indexedFileQueue) next() (*types.Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.promote(time.Now().UnixMilli())
+
+	if len(s.index) == 0 {
+		return nil, errQueueEmpty
+	}
+
+	entry := heap.Pop(&s.index).(*indexedEntry)
+	payload, err := s.readPayload(entry)
+	record := &indexedRecord{}
+
+	if err == nil {
+		err = errors.Wrap(codec.Unmarshal(payload, record), "failed to parse indexed queue record")
+	}
+
+	if err == nil && record.Message == nil {
+		err = errCorruptRecord
+	}
+
+	if err != nil {
+		// The record can never be delivered, set it aside so it does not block the queue
+		if dlqErr := s.deadLetter(entry, payload, err.Error(), entry.deliveries); dlqErr != nil {
+			log.Error(dlqErr)
+		}
+
+		return nil, errors.Wrapf(err, "unreadable message %s in queue %s", entry.id, s.name)
+	}
+
+	// Only reached when earlier deliveries never ended, such as when
+	// processing the message brought the process down
+	if s.exhausted(entry) {
+		if err := s.deadLetterMessage(entry, *record.Message, entry.deliveries); err != nil {
+			log.Error(err)
+		}
+
+		return nil, errors.Errorf("message %s in queue %s was delivered %d times without ending", entry.id, s.name, entry.deliveries)
+	}
+
+	if err := s.appendOp(recordDeliver, entry.seq); err != nil {
+		heap.Push(&s.index, entry)
+
+		return nil, errors.Wrap(err, "failed to record indexed queue delivery")
+	}
+
+	entry.deliveries += 1
+	s.claimed[entry.id] = entry
+	record.Message.ID = entry.id
+
+	return record.Message, nil
+}
+
+func (s *indexedFileQueue) push(entry *indexedEntry, now int64) {
+	if entry.notBefore > now {
+		heap.Push(&s.delayed, entry)
+	} else {
+		heap.Push(&s.index, entry)
+	}
+}
+
+// Moves delayed messages that are now due into the priority index
+func (s *indexedFileQueue) promote(now int64) {
+	for len(s.delayed.indexedHeap) > 0 && s.delayed.indexedHeap[0].notBefore <= now {
+		heap.Push(&s.index, heap.Pop(&s.delayed))
+	}
+}
+
+// Fires when the earliest delayed message is due, never if there are none
+func (s *indexedFileQueue) nextDue() <-chan time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.delayed.indexedHeap) == 0 {
+		return nil
+	}
+
+	return time.After(time.Until(time.UnixMilli(s.delayed.indexedHeap[0].notBefore)))
+}
+
+// Returns a message that never reached a consumer, its delivery is not counted
+func (s *indexedFileQueue) release(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if entry, ok := s.claimed[id]; ok {
+		delete(s.claimed, id)
+		heap.Push(&s.index, entry)
+
+		if err := s.appendOp(recordRelease, entry.seq); err != nil {
+			log.Errorf("failed to record release of %s in queue %s: %s", id, s.name, err)
+		} else {
+			entry.deliveries -= 1
+		}
+	}
+}
+
+func (s *indexedFileQueue) exhausted(entry *indexedEntry) bool {
+	return s.maxAttempts > 0 && entry.deliveries >= s.maxAttempts
+}
+
+func (s *indexedFileQueue) ack(entry *indexedEntry) error {
+	if err := s.appendOp(recordAck, entry.seq); err != nil {
+		return errors.Wrap(err, "failed to append indexed queue ack")
+	}
+
+	s.live[entry.segment] -= 1
+
+	return s.compact()
+}
+
+// Appends a record about an earlier put
+func (s *indexedFileQueue) appendOp(op string, seq uint64) error {
+	payload, err := codec.Marshal(indexedRecord{Op: op, Seq: seq})
+
+	if err != nil {
+		return errors.Wrapf(err, "failed to serialize indexed queue %s", op)
+	}
+
+	_, _, err = s.append(payload)
+
+	return err
+}
+
+func (s *indexedFileQueue) MoveDeadLetters(to Queue, priority int, limit int) (int, error) {
+	return moveDeadLetters(s.dlqPath, to, priority, limit)
+}
+
+func (s *indexedFileQueue) deadLetterMessage(entry *indexedEntry, message types.Message, attempts int) error {
+	message.ID = entry.id
+	data, err := codec.Marshal(message)
+
+	if err != nil {
+		return errors.Wrap(err, "failed to serialize dead letter")
+	}
+
+	return s.deadLetter(entry, data, fmt.Sprintf("exceeded max attempts (%d)", s.maxAttempts), attempts)
+}
+
+// Writes the data of an entry to the DLQ directory and acknowledges it. The
+// entry stays in the log if the write fails, so it is recovered on restart.
+func (s *indexedFileQueue) deadLetter(entry *indexedEntry, data []byte, reason string, attempts int) error {
+	if err := os.WriteFile(filepath.Join(s.dlqPath, entry.id), data, 0644); err != nil {
+		return errors.Wrap(err, "failed to write dead letter")
+	}
+
+	if err := writeDeadLetterReason(s.name, s.dlqPath, entry.id, reason, attempts); err != nil {
+		return err
+	}
+
+	return s.ack(entry)
+}
+
+// Removes fully acknowledged segments from the head of the log. Acks are always
+// written after their put, so deleting in order never resurrects a message.
+func (s *indexedFileQueue) compact() error {
+	for len(s.segments) > 0 {
+		id := s.segments[0]
+
+		if id == s.activeID || s.live[id] > 0 {
+			return nil
+		}
+
+		if reader, ok := s.readers[id]; ok {
+			reader.Close()
+			delete(s.readers, id)
+		}
+
+		if err := os.Remove(s.segmentPath(id)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to remove indexed queue segment")
+		}
+
+		delete(s.live, id)
+		s.segments = s.segments[1:]
+	}
+
+	return nil
+}
+
+func (s *indexedFileQueue) append(payload []byte) (uint64, int64, error) {
+	size := int64(recordHeaderSize + len(payload))
+
+	if s.activeSize > 0 && s.activeSize+size > s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[recordHeaderSize:], payload)
+
+	if _, err := s.active.Write(buf); err != nil {
+		// Drop the partial record so later appends remain readable
+		if truncErr := s.active.Truncate(s.activeSize); truncErr != nil {
+			log.Errorf("failed to truncate indexed queue segment: %s", truncErr)
+		}
+
+		return 0, 0, err
+	}
+
+	if s.sync {
+		if err := s.active.Sync(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	offset := s.activeSize + recordHeaderSize
+	s.activeSize += size
+
+	return s.activeID, offset, nil
+}
+
+func (s *indexedFileQueue) rotate() error {
+	if err := s.active.Close(); err != nil {
+		return errors.Wrap(err, "failed to close indexed queue segment")
+	}
+
+	s.activeID += 1
+
+	return s.openActive()
+}
+
+func (s *indexedFileQueue) openActive() error {
+	f, err := os.OpenFile(s.segmentPath(s.activeID), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		return errors.Wrap(err, "failed to open indexed queue segment")
+	}
+
+	s.active = f
+	s.activeSize = 0
+	s.segments = append(s.segments, s.activeID)
+
+	return nil
+}
+
+func (s *indexedFileQueue) readRecord(entry *indexedEntry) (*indexedRecord, error) {
+	payload, err := s.readPayload(entry)
+
+	if err != nil {
+		return nil, err
+	}
+
+	record := &indexedRecord{}
+
+	return record, errors.Wrap(codec.Unmarshal(payload, record), "failed to parse indexed queue record")
+}
+
+// Reads the record of an entry along with its header. The payload is returned
+// even when its checksum does not match, so it can be set aside.
+func (s *indexedFileQueue) readPayload(entry *indexedEntry) ([]byte, error) {
+	reader, ok := s.readers[entry.segment]
+
+	if !ok {
+		f, err := os.Open(s.segmentPath(entry.segment))
+
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open indexed queue segment")
+		}
+
+		reader = f
+		s.readers[entry.segment] = f
+	}
+
+	b := make([]byte, recordHeaderSize+entry.length)
+
+	if _, err := reader.ReadAt(b, entry.offset-recordHeaderSize); err != nil {
+		return nil, errors.Wrap(err, "failed to read indexed queue record")
+	}
+
+	if _, err := readSegmentRecord(b); err != nil {
+		return b[recordHeaderSize:], err
+	}
+
+	return b[recordHeaderSize:], nil
+}
+
+// Replays a segment into entries. A torn record at the tail of the final
+// segment is the result of a crash mid-write and is truncated away if asked.
+func (s *indexedFileQueue) loadSegment(id uint64, entries map[uint64]*indexedEntry, truncate bool) error {
+	path := s.segmentPath(id)
+	contents, err := os.ReadFile(path)
+
+	if err != nil {
+		return errors.Wrap(err, "failed to read indexed queue segment")
+	}
+
+	var offset int64
+
+	for offset < int64(len(contents)) {
+		payload, err := readSegmentRecord(contents[offset:])
+
+		if err == errCorruptRecord && truncate {
+			log.Errorf("truncating torn record in queue %s segment %d at offset %d", s.name, id, offset)
+			return errors.Wrap(os.Truncate(path, offset), "failed to truncate indexed queue segment")
+		} else if err != nil {
+			log.Errorf("skipping remainder of queue %s segment %d at offset %d", s.name, id, offset)
+			return nil
+		}
+
+		record := indexedRecord{}
+
+		if err := codec.Unmarshal(payload, &record); err != nil {
+			return errors.Wrap(err, "failed to parse indexed queue record")
+		}
+
+		switch record.Op {
+		case recordPut:
+			entries[record.Seq] = &indexedEntry{
+				id:        s.getID(record.Priority, record.Seq),
+				seq:       record.Seq,
+				priority:  record.Priority,
+				notBefore: record.NotBefore,
+				segment:   id,
+				offset:    offset + recordHeaderSize,
+				length:    int64(len(payload)),
+			}
+		case recordAck:
+			delete(entries, record.Seq)
+		case recordDeliver:
+			if entry, ok := entries[record.Seq]; ok {
+				entry.deliveries += 1
+			}
+		case recordRelease:
+			if entry, ok := entries[record.Seq]; ok {
+				entry.deliveries -= 1
+			}
+		}
+
+		if record.Seq >= s.seq {
+			s.seq = record.Seq + 1
+		}
+
+		offset += int64(recordHeaderSize + len(payload))
+	}
+
+	return nil
+}
+
+func (s *indexedFileQueue) listSegments() ([]uint64, error) {
+	files, err := ioutil.ReadDir(s.path)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read indexed queue directory")
+	}
+
+	var segments []uint64
+
+	for _, file := range files {
+		name := file.Name()
+
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, id)
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+
+	return segments, nil
+}
+
+func (s *indexedFileQueue) closeFiles() error {
+	for id, reader := range s.readers {
+		reader.Close()
+		delete(s.readers, id)
+	}
+
+	if s.active == nil {
+		return nil
+	}
+
+	err := s.active.Close()
+	s.active = nil
+
+	return errors.Wrap(err, "failed to close indexed queue segment")
+}
+
+func (s *indexedFileQueue) signal() {
+	select {
+	case s.notify <- true:
+	default:
+	}
+}
+
+func (s *indexedFileQueue) getID(priority int, seq uint64) string {
+	return fmt.Sprintf("%d-%d-%s", priority, seq, s.name)
+}
+
+// Priority is the first token of an entry ID
+func getIndexedPriority(id string) int {
+	priority, err := strconv.Atoi(strings.SplitN(id, "-", 2)[0])
+
+	if err != nil {
+		return 0
+	}
+
+	return priority
+}
+
+func (s *indexedFileQueue) segmentPath(id uint64) string {
+	return filepath.Join(s.path, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+func readSegmentRecord(b []byte) ([]byte, error) {
+	if len(b) < recordHeaderSize {
+		return nil, errCorruptRecord
+	}
+
+	length := int(binary.BigEndian.Uint32(b[0:4]))
+	checksum := binary.BigEndian.Uint32(b[4:8])
+
+	if len(b) < recordHeaderSize+length {
+		return nil, errCorruptRecord
+	}
+
+	payload := b[recordHeaderSize : recordHeaderSize+length]
+
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, errCorruptRecord
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,379 @@
+package queue
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/types"
+	"github.com/iakinsey/delver/util"
+)
+
+func newTestIndexedFileQueue(path string, segmentSize int64) *indexedFileQueue {
+	return newTestIndexedFileQueueWithParams(IndexedFileQueueParams{
+		Path:        path,
+		SegmentSize: segmentSize,
+	})
+}
+
+func newTestIndexedFileQueueWithParams(params IndexedFileQueueParams) *indexedFileQueue {
+	params.Name = "TestIndexedFileQueue"
+
+	return NewIndexedFileQueue(params).(*indexedFileQueue)
+}
+
+func TestIndexedFileQueue(t *testing.T) {
+	path := util.MakeTempFolder("TestIndexedFileQueue")
+	defer os.RemoveAll(path)
+
+	q := newTestIndexedFileQueue(path, 0)
+
+	for i, priority := range []int{3, 1, 2} {
+		msg, _ := types.NewMessage(i, types.FetcherRequestType)
+		assert.NoError(t, q.Put(msg, priority))
+	}
+
+	assert.Equal(t, int64(3), q.Len())
+
+	claimed, err := q.next()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(claimed.Message))
+	assert.NoError(t, q.EndTransaction(*claimed, false))
+
+	claimed, err = q.next()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(claimed.Message))
+	assert.NoError(t, q.EndTransaction(*claimed, true))
+	assert.Error(t, q.EndTransaction(*claimed, true))
+	assert.NoError(t, q.Start())
+
+	msg := <-q.GetChannel()
+
+	assert.Equal(t, "2", string(msg.Message))
+	assert.Equal(t, int64(2), q.Len())
+	assert.NoError(t, q.Stop())
+
+	// Unacknowledged messages survive a restart, acknowledged ones do not
+	q = newTestIndexedFileQueue(path, 0)
+
+	assert.Equal(t, int64(2), q.Len())
+
+	claimed, err = q.next()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "2", string(claimed.Message))
+	assert.NoError(t, q.EndTransaction(*claimed, true))
+
+	claimed, err = q.next()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "0", string(claimed.Message))
+	assert.NoError(t, q.EndTransaction(*claimed, true))
+
+	_, err = q.next()
+
+	assert.Equal(t, errQueueEmpty, err)
+}
+
+func TestIndexedFileQueueSegments(t *testing.T) {
+	path := util.MakeTempFolder("TestIndexedFileQueueSegments")
+	defer os.RemoveAll(path)
+
+	q := newTestIndexedFileQueue(path, 128)
+
+	for i := 0; i < 10; i++ {
+		msg, _ := types.NewMessage(i, types.FetcherRequestType)
+		assert.NoError(t, q.Put(msg, 0))
+	}
+
+	segments, err := q.listSegments()
+
+	assert.NoError(t, err)
+	assert.Greater(t, len(segments), 1)
+
+	for i := 0; i < 10; i++ {
+		claimed, err := q.next()
+
+		assert.NoError(t, err)
+		assert.NoError(t, q.EndTransaction(*claimed, true))
+	}
+
+	segments, err = q.listSegments()
+
+	assert.NoError(t, err)
+	assert.Len(t, segments, 1)
+}
+
+func TestIndexedFileQueueTornWrite(t *testing.T) {
+	path := util.MakeTempFolder("TestIndexedFileQueueTornWrite")
+	defer os.RemoveAll(path)
+
+	q := newTestIndexedFileQueue(path, 0)
+	msg, _ := types.NewMessage("test", types.FetcherRequestType)
+
+	assert.NoError(t, q.Put(msg, 0))
+
+	segmentPath := q.segmentPath(q.activeID)
+	f, err := os.OpenFile(segmentPath, os.O_WRONLY|os.O_APPEND, 0644)
+
+	assert.NoError(t, err)
+
+	_, err = f.Write([]byte{0, 0, 1, 0, 1, 2})
+
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	q = newTestIndexedFileQueue(path, 0)
+
+	assert.Equal(t, int64(1), q.Len())
+
+	claimed, err := q.next()
+
+	assert.NoError(t, err)
+	assert.Equal(t, msg.Message, claimed.Message)
+}
+
+func TestIndexedFileQueuePutAt(t *testing.T) {
+	path := util.MakeTempFolder("TestIndexedFileQueuePutAt")
+	defer os.RemoveAll(path)
+
+	q := newTestIndexedFileQueue(path, 0)
+	delayed, _ := types.NewMessage("delayed", types.FetcherRequestType)
+	ready, _ := types.NewMessage("ready", types.FetcherRequestType)
+
+	assert.NoError(t, q.PutAt(delayed, 0, time.Now().Add(time.Hour)))
+	assert.NoError(t, q.Put(ready, 5))
+	assert.Equal(t, int64(2), q.Len())
+
+	claimed, err := q.next()
+
+	assert.NoError(t, err)
+	assert.Equal(t, ready.Message, claimed.Message)
+	assert.NoError(t, q.EndTransaction(*claimed, true))
+
+	_, err = q.next()
+
+	assert.Equal(t, errQueueEmpty, err)
+
+	// The delay survives a restart
+	q = newTestIndexedFileQueue(path, 0)
+
+	assert.Equal(t, int64(1), q.Len())
+	assert.Len(t, q.delayed.indexedHeap, 1)
+
+	q.delayed.indexedHeap[0].notBefore = time.Now().UnixMilli()
+	claimed, err = q.next()
+
+	assert.NoError(t, err)
+	assert.Equal(t, delayed.Message, claimed.Message)
+}
+
+func TestIndexedFileQueuePeekPurge(t *testing.T) {
+	path := util.MakeTempFolder("TestIndexedFileQueuePeekPurge")
+	defer os.RemoveAll(path)
+
+	q := newTestIndexedFileQueue(path, 0)
+
+	for i, priority := range []int{2, 1, 3} {
+		msg, _ := types.NewMessage(i, types.FetcherRequestType)
+		assert.NoError(t, q.Put(msg, priority))
+	}
+
+	messages, err := q.Peek(2)
+
+	assert.NoError(t, err)
+	assert.Len(t, messages, 2)
+	assert.Equal(t, "1", string(messages[0].Message))
+	assert.Equal(t, "0", string(messages[1].Message))
+
+	count, err := q.Purge()
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, int64(0), q.Len())
+
+	// Purged messages stay gone after a restart
+	q = newTestIndexedFileQueue(path, 0)
+
+	assert.Equal(t, int64(0), q.Len())
+}
+
+func TestIndexedFileQueueDeadLetter(t *testing.T) {
+	path := util.MakeTempFolder("TestIndexedFileQueueDeadLetter")
+	defer os.RemoveAll(path)
+
+	q := newTestIndexedFileQueueWithParams(IndexedFileQueueParams{
+		Path:        path,
+		SegmentSize: 128,
+		MaxAttempts: 2,
+	})
+	poison, _ := types.NewMessage("poison", types.FetcherRequestType)
+
+	assert.NoError(t, q.Put(poison, 0))
+
+	for i := 0; i < 10; i++ {
+		msg, _ := types.NewMessage(i, types.FetcherRequestType)
+		assert.NoError(t, q.Put(msg, 1))
+	}
+
+	for i := 0; i < 2; i++ {
+		claimed, err := q.next()
+
+		assert.NoError(t, err)
+		assert.Equal(t, poison.Message, claimed.Message)
+		assert.NoError(t, q.EndTransaction(*claimed, false))
+	}
+
+	assertDirSize(t, q.dlqPath, 2)
+
+	for i := 0; i < 10; i++ {
+		claimed, err := q.next()
+
+		assert.NoError(t, err)
+		assert.NoError(t, q.EndTransaction(*claimed, true))
+	}
+
+	// The poison message no longer holds back compaction
+	segments, err := q.listSegments()
+
+	assert.NoError(t, err)
+	assert.Len(t, segments, 1)
+
+	count, err := q.RequeueDeadLetters()
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assertDirSize(t, q.dlqPath, 0)
+
+	claimed, err := q.next()
+
+	assert.NoError(t, err)
+	assert.Equal(t, poison.Message, claimed.Message)
+}
+
+// A message that brings the process down while being processed is never
+// ended, its deliveries are replayed from the log after each restart
+func TestIndexedFileQueueDeadLetterAfterCrash(t *testing.T) {
+	path := util.MakeTempFolder("TestIndexedFileQueueDeadLetterAfterCrash")
+	defer os.RemoveAll(path)
+
+	params := IndexedFileQueueParams{Path: path, MaxAttempts: 2}
+	q := newTestIndexedFileQueueWithParams(params)
+	poison, _ := types.NewMessage("poison", types.FetcherRequestType)
+
+	assert.NoError(t, q.Put(poison, 0))
+
+	for i := 0; i < 2; i++ {
+		claimed, err := q.next()
+
+		assert.NoError(t, err)
+		assert.Equal(t, poison.Message, claimed.Message)
+		assert.NoError(t, q.closeFiles())
+
+		q = newTestIndexedFileQueueWithParams(params)
+	}
+
+	_, err := q.next()
+
+	assert.Error(t, err)
+	assertDirSize(t, q.dlqPath, 2)
+	assert.Equal(t, int64(0), q.Len())
+}
+
+func TestIndexedFileQueuePrepareTwice(t *testing.T) {
+	path := util.MakeTempFolder("TestIndexedFileQueuePrepareTwice")
+	defer os.RemoveAll(path)
+
+	q := newTestIndexedFileQueue(path, 0)
+	msg, _ := types.NewMessage("prepared", types.FetcherRequestType)
+
+	assert.NoError(t, q.Put(msg, 0))
+
+	claimed, err := q.next()
+
+	assert.NoError(t, err)
+	assert.NoError(t, q.Prepare())
+
+	// The claim survives and no extra segment is left behind
+	segments, err := q.listSegments()
+
+	assert.NoError(t, err)
+	assert.Len(t, segments, 1)
+	assert.NoError(t, q.EndTransaction(*claimed, true))
+	assert.Equal(t, int64(0), q.Len())
+}
+
+func TestIndexedFileQueueCorruptRecord(t *testing.T) {
+	path := util.MakeTempFolder("TestIndexedFileQueueCorruptRecord")
+	defer os.RemoveAll(path)
+
+	q := newTestIndexedFileQueue(path, 0)
+	corrupt, _ := types.NewMessage("corrupt", types.FetcherRequestType)
+	intact, _ := types.NewMessage("intact", types.FetcherRequestType)
+
+	assert.NoError(t, q.Put(corrupt, 0))
+	assert.NoError(t, q.Put(intact, 1))
+
+	f, err := os.OpenFile(q.segmentPath(q.activeID), os.O_WRONLY, 0644)
+
+	assert.NoError(t, err)
+
+	_, err = f.WriteAt([]byte("x"), q.index[0].offset)
+
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	_, err = q.next()
+
+	assert.ErrorIs(t, err, errCorruptRecord)
+	assertDirSize(t, q.dlqPath, 2)
+
+	claimed, err := q.next()
+
+	assert.NoError(t, err)
+	assert.Equal(t, intact.Message, claimed.Message)
+}
+
+func TestIndexedFileQueueReader(t *testing.T) {
+	path := util.MakeTempFolder("TestIndexedFileQueueReader")
+	defer os.RemoveAll(path)
+
+	q := newTestIndexedFileQueue(path, 0)
+	msg, _ := types.NewMessage("test", types.FetcherRequestType)
+
+	assert.NoError(t, q.Put(msg, 0))
+
+	claimed, err := q.next()
+
+	assert.NoError(t, err)
+
+	before, err := q.listSegments()
+
+	assert.NoError(t, err)
+
+	reader, err := OpenReader(config.Resource{
+		Type:       "indexed_file_queue",
+		Parameters: json.RawMessage(`{"name": "TestIndexedFileQueue", "path": "` + path + `"}`),
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), reader.Len())
+
+	messages, err := reader.Peek(0)
+
+	assert.NoError(t, err)
+	assert.Equal(t, msg.Message, messages[0].Message)
+
+	// Opening for inspection neither rotates nor compacts the log
+	after, err := q.listSegments()
+
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+	assert.NoError(t, q.EndTransaction(*claimed, true))
+}
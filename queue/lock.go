@@ -0,0 +1,69 @@
+package queue
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/resource"
+	"github.com/iakinsey/delver/util"
+)
+
+const lockSuffix = ".lock"
+
+var ErrQueueLocked = errors.New("queue is in use by another process")
+
+// Takes an exclusive lock on a file backed queue, so two processes never
+// write to the same queue directory. The lock file sits next to the queue
+// directory and the lock is held until released or the process exits. Other
+// queue types are not locked.
+func Lock(rc config.Resource) (release func() error, err error) {
+	var path string
+
+	switch rc.Type {
+	case "file_queue":
+		params := FileQueueParams{}
+		err = resource.ParseParams(rc.Parameters, &params)
+		path = params.Path
+	case "indexed_file_queue":
+		params := IndexedFileQueueParams{}
+		err = resource.ParseParams(rc.Parameters, &params)
+		path = params.Path
+	default:
+		return func() error { return nil }, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return lockPath(path)
+}
+
+func lockPath(path string) (func() error, error) {
+	path = filepath.Clean(path)
+
+	if err := util.GetOrCreateDir(filepath.Dir(path)); err != nil {
+		return nil, errors.Wrap(err, "failed to create queue lock directory")
+	}
+
+	f, err := os.OpenFile(path+lockSuffix, os.O_CREATE|os.O_RDWR, 0644)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open queue lock")
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		f.Close()
+		return nil, errors.Wrap(ErrQueueLocked, path)
+	} else if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "failed to lock queue")
+	}
+
+	// Closing the file releases the lock
+	return f.Close, nil
+}
@@ -0,0 +1,41 @@
+package queue
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/util"
+)
+
+func TestLock(t *testing.T) {
+	path := util.MakeTempFolder("TestLock")
+
+	defer os.RemoveAll(path)
+	defer os.Remove(path + lockSuffix)
+
+	parameters, _ := json.Marshal(FileQueueParams{Path: path})
+	rc := config.Resource{Name: "locked", Type: "file_queue", Parameters: parameters}
+	release, err := Lock(rc)
+
+	assert.NoError(t, err)
+
+	_, err = Lock(rc)
+
+	assert.True(t, errors.Is(err, ErrQueueLocked))
+	assert.NoError(t, release())
+
+	release, err = Lock(rc)
+
+	assert.NoError(t, err)
+	assert.NoError(t, release())
+
+	// Queues without a directory are not locked
+	_, err = Lock(config.Resource{Name: "channel", Type: "channel_queue"})
+
+	assert.NoError(t, err)
+}
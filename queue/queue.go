@@ -1,13 +1,82 @@
 package queue
 
-import "github.com/iakinsey/delver/types"
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/resource"
+	"github.com/iakinsey/delver/types"
+)
+
+var ErrQueueFull = errors.New("queue is full")
+
+var ErrNoReader = errors.New("queue type can not be opened read only")
 
 type Queue interface {
 	Start() error
 	Stop() error
 	GetChannel() chan types.Message
 	Put(types.Message, int) error
+	// Delivers the message no earlier than the given time
+	PutAt(types.Message, int, time.Time) error
 	Prepare() error
 	EndTransaction(types.Message, bool) error
 	Len() int64
 }
+
+// Implemented by queues that set aside messages which repeatedly fail
+type DeadLetterQueue interface {
+	RequeueDeadLetters() (int, error)
+	// Moves dead letters into another queue, a limit of 0 or less moves all
+	MoveDeadLetters(to Queue, priority int, limit int) (int, error)
+}
+
+// Implemented by queues with a maximum size, allows producers to back off
+type BoundedQueue interface {
+	Full() bool
+}
+
+// Implemented by queues whose pending messages can be read without claiming
+// them, in delivery order. A limit of 0 or less returns every message.
+type PeekableQueue interface {
+	Peek(int) ([]types.Message, error)
+}
+
+// Implemented by queues that can discard every pending message at once
+type PurgeableQueue interface {
+	Purge() (int, error)
+}
+
+// A queue opened for inspection only
+type Reader interface {
+	Len() int64
+	PeekableQueue
+}
+
+// Opens a file backed queue without the recovery and compaction done when a
+// queue is created, so a queue in use by another process can be inspected.
+// Returns ErrNoReader for other queue types.
+func OpenReader(rc config.Resource) (Reader, error) {
+	switch rc.Type {
+	case "file_queue":
+		params := FileQueueParams{}
+
+		if err := resource.ParseParams(rc.Parameters, &params); err != nil {
+			return nil, err
+		}
+
+		return openFileQueueReader(params)
+	case "indexed_file_queue":
+		params := IndexedFileQueueParams{}
+
+		if err := resource.ParseParams(rc.Parameters, &params); err != nil {
+			return nil, err
+		}
+
+		return openIndexedFileQueueReader(params)
+	default:
+		return nil, errors.Wrap(ErrNoReader, rc.Type)
+	}
+}
@@ -2,14 +2,25 @@ package queue
 
 import (
 	"encoding/json"
-	"errors"
+	"math/rand"
+	"os"
+	"reflect"
 	"time"
 
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/resource"
 	"github.com/iakinsey/delver/types"
 )
 
 type timerQueue struct {
 	delay      time.Duration
+	schedule   *cronSchedule
+	jitter     time.Duration
+	statePath  string
+	last       time.Time
 	channel    chan types.Message
 	terminate  chan bool
 	terminated chan bool
@@ -17,11 +28,40 @@ type timerQueue struct {
 
 type TimerQueueParams struct {
 	Delay time.Duration `json:"delay"`
+	// Cron expression, takes precedence over Delay when set
+	Cron string `json:"cron"`
+	// Random extra delay of up to this long added to each fire
+	Jitter time.Duration `json:"jitter"`
+	// File recording the last fire time so restarts resume the schedule
+	StatePath string `json:"state_path"`
+}
+
+func init() {
+	resource.Register("timer", resource.Factory{
+		Params: func(_ config.Resource) interface{} { return &TimerQueueParams{} },
+		New: func(params interface{}) interface{} {
+			return NewTimerQueue(*params.(*TimerQueueParams))
+		},
+		Type: reflect.TypeOf((*Queue)(nil)).Elem(),
+	})
 }
 
 func NewTimerQueue(params TimerQueueParams) Queue {
+	var schedule *cronSchedule
+
+	if params.Cron != "" {
+		var err error
+
+		if schedule, err = parseCron(params.Cron); err != nil {
+			log.Fatalf("failed to create timer: %s", err)
+		}
+	}
+
 	return &timerQueue{
 		delay:      params.Delay,
+		schedule:   schedule,
+		jitter:     params.Jitter,
+		statePath:  params.StatePath,
 		channel:    make(chan types.Message),
 		terminate:  make(chan bool),
 		terminated: make(chan bool),
@@ -35,12 +75,12 @@ func (s *timerQueue) Start() error {
 }
 
 func (s *timerQueue) perform() {
-	s.notify()
-
 	for {
 		select {
-		case <-time.After(s.delay):
-			s.notify()
+		case <-time.After(time.Until(s.nextFire())):
+			if !s.notify() {
+				return
+			}
 		case <-s.terminate:
 			s.terminated <- true
 			return
@@ -48,15 +88,95 @@ func (s *timerQueue) perform() {
 	}
 }
 
-func (s *timerQueue) notify() {
-	time, _ := json.Marshal(time.Now().Unix())
+// Interval timers fire straight away unless a previous fire is known, cron
+// timers always wait for the next matching time
+func (s *timerQueue) nextFire() time.Time {
+	now := time.Now()
+	next := now
+
+	if s.schedule != nil {
+		if next = s.schedule.Next(now); next.IsZero() {
+			// The expression never matches, sleep for as long as possible
+			return now.Add(cronSearchLimit)
+		}
+	} else if !s.last.IsZero() && s.last.Add(s.delay).After(now) {
+		next = s.last.Add(s.delay)
+	}
 
-	s.channel <- types.Message{
+	if s.jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(s.jitter))))
+	}
+
+	return next
+}
+
+func (s *timerQueue) notify() bool {
+	now := time.Now()
+	messageType, payload, _ := types.EncodeMessage(now.Unix())
+	message := types.Message{
 		ID:          string(types.NewV4()),
-		MessageType: types.TimerType,
-		Message:     json.RawMessage(time),
+		MessageType: messageType,
+		Message:     payload,
+	}
+
+	select {
+	case s.channel <- message:
+	case <-s.terminate:
+		s.terminated <- true
+		return false
+	}
+
+	s.last = now
+
+	if err := s.saveState(); err != nil {
+		log.Errorf("failed to save timer state: %s", err)
+	}
+
+	return true
+}
+
+func (s *timerQueue) saveState() error {
+	if s.statePath == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(s.last.Unix())
+
+	if err != nil {
+		return err
+	}
+
+	tmp := s.statePath + writingSuffix
+
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return errors.Wrap(err, "failed to write timer state")
 	}
 
+	return errors.Wrap(os.Rename(tmp, s.statePath), "failed to commit timer state")
+}
+
+func (s *timerQueue) loadState() error {
+	if s.statePath == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(s.statePath)
+
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to read timer state")
+	}
+
+	var last int64
+
+	if err := json.Unmarshal(b, &last); err != nil {
+		return errors.Wrap(err, "failed to parse timer state")
+	}
+
+	s.last = time.Unix(last, 0)
+
+	return nil
 }
 
 func (s *timerQueue) Stop() error {
@@ -74,8 +194,12 @@ func (s *timerQueue) Put(types.Message, int) error {
 	return errors.New("timerQueue.Put not implemented")
 }
 
+func (s *timerQueue) PutAt(types.Message, int, time.Time) error {
+	return errors.New("timerQueue.PutAt not implemented")
+}
+
 func (s *timerQueue) Prepare() error {
-	return nil
+	return s.loadState()
 }
 
 func (s *timerQueue) EndTransaction(types.Message, bool) error {
@@ -0,0 +1,37 @@
+package queue
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iakinsey/delver/util"
+)
+
+func TestTimerQueueResumesFromState(t *testing.T) {
+	path := util.MakeTempFolder("TestTimerQueue")
+	defer os.RemoveAll(path)
+
+	params := TimerQueueParams{
+		Delay:     time.Hour,
+		StatePath: filepath.Join(path, "timer"),
+	}
+	q := NewTimerQueue(params).(*timerQueue)
+
+	assert.NoError(t, q.Prepare())
+	assert.WithinDuration(t, time.Now(), q.nextFire(), time.Second)
+	assert.NoError(t, q.Start())
+
+	<-q.GetChannel()
+
+	assert.NoError(t, q.Stop())
+
+	// A restart waits out the remainder of the interval instead of firing
+	q = NewTimerQueue(params).(*timerQueue)
+
+	assert.NoError(t, q.Prepare())
+	assert.WithinDuration(t, time.Now().Add(time.Hour), q.nextFire(), 2*time.Second)
+}
@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"reflect"
 	"strconv"
 	"strings"
 
 	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/resource"
 	"github.com/iakinsey/delver/util"
 	"github.com/pkg/errors"
 	"github.com/twmb/murmur3"
@@ -106,6 +109,16 @@ type BloomFilterParams struct {
 	P    float64 `json:"p"`
 }
 
+func init() {
+	resource.Register("bloom_filter", resource.Factory{
+		Params: func(_ config.Resource) interface{} { return &BloomFilterParams{} },
+		New: func(params interface{}) interface{} {
+			return NewBloomFilter(*params.(*BloomFilterParams))
+		},
+		Type: reflect.TypeOf((*BloomFilter)(nil)).Elem(),
+	})
+}
+
 func NewBloomFilter(params BloomFilterParams) BloomFilter {
 	return newBloomFilter(params.MaxN, params.P, roaring64.New())
 }
@@ -2,12 +2,16 @@ package bloom
 
 import (
 	"os"
+	"reflect"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/pkg/errors"
+
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/resource"
 )
 
 type rollingBloomFilter struct {
@@ -29,6 +33,16 @@ type RollingBloomFilterParams struct {
 	SaveInterval time.Duration `json:"save_interval"`
 }
 
+func init() {
+	resource.Register("rolling_bloom_filter", resource.Factory{
+		Params: func(_ config.Resource) interface{} { return &RollingBloomFilterParams{} },
+		New: func(params interface{}) interface{} {
+			return NewRollingBloomFilter(*params.(*RollingBloomFilterParams))
+		},
+		Type: reflect.TypeOf((*BloomFilter)(nil)).Elem(),
+	})
+}
+
 func NewRollingBloomFilter(params RollingBloomFilterParams) BloomFilter {
 	if params.Path == "" {
 		return newRollingBloomFilter(params.BloomCount, params.MaxN, params.P)
@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"net/url"
 	"path"
+	"reflect"
 
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/resource"
 	"github.com/iakinsey/delver/util"
 	"github.com/pkg/errors"
 )
@@ -19,6 +22,16 @@ type MultiHostMapParams struct {
 	BasePath string `json:"base_path"`
 }
 
+func init() {
+	resource.Register("multi_host_map", resource.Factory{
+		Params: func(_ config.Resource) interface{} { return &MultiHostMapParams{} },
+		New: func(params interface{}) interface{} {
+			return NewMultiHostMap(*params.(*MultiHostMapParams))
+		},
+		Type: reflect.TypeOf((*Map)(nil)).Elem(),
+	})
+}
+
 func NewMultiHostMap(params MultiHostMapParams) Map {
 	m := &multiHostMap{
 		basePath: params.BasePath,
@@ -1,9 +1,11 @@
 package maps
 
 import (
+	"reflect"
 	"time"
 
 	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/resource"
 	log "github.com/sirupsen/logrus"
 
 	badger "github.com/dgraph-io/badger/v3"
@@ -20,6 +22,16 @@ type PersistentMapParams struct {
 	Path string `json:"path"`
 }
 
+func init() {
+	resource.Register("persistent_map", resource.Factory{
+		Params: func(_ config.Resource) interface{} { return &PersistentMapParams{} },
+		New: func(params interface{}) interface{} {
+			return NewPersistentMap(*params.(*PersistentMapParams))
+		},
+		Type: reflect.TypeOf((*Map)(nil)).Elem(),
+	})
+}
+
 func NewPersistentMap(params PersistentMapParams) Map {
 	opts := badger.DefaultOptions(params.Path)
 	opts.Logger = nil
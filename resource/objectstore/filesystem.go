@@ -6,7 +6,10 @@ import (
 	"io"
 	"os"
 	"path"
+	"reflect"
 
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/resource"
 	"github.com/iakinsey/delver/types"
 	"github.com/iakinsey/delver/util"
 	"github.com/pkg/errors"
@@ -21,6 +24,16 @@ type FilesystemObjectStoreParams struct {
 	Path string `json:"path"`
 }
 
+func init() {
+	resource.Register("filesystem_object_store", resource.Factory{
+		Params: func(_ config.Resource) interface{} { return &FilesystemObjectStoreParams{} },
+		New: func(params interface{}) interface{} {
+			return NewFilesystemObjectStore(*params.(*FilesystemObjectStoreParams))
+		},
+		Type: reflect.TypeOf((*ObjectStore)(nil)).Elem(),
+	})
+}
+
 func NewFilesystemObjectStore(params FilesystemObjectStoreParams) ObjectStore {
 	if err := util.GetOrCreateDir(params.Path); err != nil {
 		log.Fatalf("failed to set up filesystem object store directory, %s", err)
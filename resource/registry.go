@@ -0,0 +1,191 @@
+package resource
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iakinsey/delver/config"
+)
+
+// Creates a resource type by name. Params returns a pointer to the parameters
+// with their defaults set, which are decoded from the resource config and
+// handed to New.
+type Factory struct {
+	Params func(conf config.Resource) interface{}
+	New    func(params interface{}) interface{}
+	// Interface of the created resources, used to validate references
+	Type reflect.Type
+}
+
+var factories = struct {
+	sync.RWMutex
+	m map[string]Factory
+}{m: make(map[string]Factory)}
+
+// Makes a resource type available to configs. Packages register their
+// resources from init, so downstream programs only need to import them.
+func Register(name string, factory Factory) {
+	factories.Lock()
+	defer factories.Unlock()
+
+	if _, ok := factories.m[name]; ok {
+		log.Fatalf("resource type %s registered twice", name)
+	}
+
+	factories.m[name] = factory
+}
+
+func GetFactory(name string) (Factory, error) {
+	factories.RLock()
+	defer factories.RUnlock()
+
+	factory, ok := factories.m[name]
+
+	if !ok {
+		return Factory{}, fmt.Errorf("unknown resource type %s", name)
+	}
+
+	return factory, nil
+}
+
+// Registered resource type names, sorted
+func Types() []string {
+	factories.RLock()
+	defer factories.RUnlock()
+
+	var names []string
+
+	for name := range factories.m {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Decodes the parameters of a resource config
+func ParseResource(conf config.Resource) (Factory, interface{}, error) {
+	factory, err := GetFactory(conf.Type)
+
+	if err != nil {
+		return factory, nil, err
+	}
+
+	params := factory.Params(conf)
+
+	return factory, params, ParseParams(conf.Parameters, params)
+}
+
+// Missing parameters leave the defaults in place
+func ParseParams(data json.RawMessage, params interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	return errors.Wrap(json.Unmarshal(data, params), "failed to parse parameters")
+}
+
+// Parses a `resource:"name[,optional]"` field tag into the name of the
+// parameter holding the resource name and whether it may be left out. The
+// name is empty for fields without a tag.
+func Tag(field reflect.StructField) (name string, optional bool) {
+	parts := strings.Split(field.Tag.Get("resource"), ",")
+
+	for _, option := range parts[1:] {
+		if option == "optional" {
+			optional = true
+		}
+	}
+
+	return parts[0], optional
+}
+
+// Returns the names of the resources referenced by the fields of params
+// tagged `resource`, keyed by tag name. The transformer queue may be left out
+// and is then referenced by its well known name, optional resources are left
+// unset.
+func References(data json.RawMessage, params interface{}) (map[string]string, error) {
+	refs := make(map[string]string)
+	names := make(map[string]string)
+	elem := reflect.TypeOf(params).Elem()
+
+	if len(data) > 0 {
+		raw := make(map[string]json.RawMessage)
+
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, errors.Wrap(err, "failed to parse resource references")
+		}
+
+		for key, value := range raw {
+			var name string
+
+			if json.Unmarshal(value, &name) == nil {
+				names[key] = name
+			}
+		}
+	}
+
+	for i := 0; i < elem.NumField(); i++ {
+		tag, optional := Tag(elem.Field(i))
+
+		if tag == "" {
+			continue
+		}
+
+		if name, ok := names[tag]; ok && (name != "" || !optional) {
+			refs[tag] = name
+		} else if tag == config.TransformerQueueName {
+			refs[tag] = config.TransformerQueueName
+		} else if !optional {
+			return nil, fmt.Errorf("missing resource parameter %s", tag)
+		}
+	}
+
+	return refs, nil
+}
+
+// Decodes parameters and sets each field tagged `resource` to the resource
+// it names
+func Bind(data json.RawMessage, params interface{}, resources map[string]interface{}) error {
+	if err := ParseParams(data, params); err != nil {
+		return err
+	}
+
+	refs, err := References(data, params)
+
+	if err != nil {
+		return err
+	}
+
+	value := reflect.ValueOf(params).Elem()
+
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		tag, _ := Tag(field)
+		name, ok := refs[tag]
+
+		if !ok {
+			continue
+		}
+
+		r, ok := resources[name]
+
+		if !ok {
+			return fmt.Errorf("resource %s not defined", name)
+		} else if !reflect.TypeOf(r).AssignableTo(field.Type) {
+			return fmt.Errorf("resource %s is a %T, parameter %s needs a %s", name, r, tag, field.Type)
+		}
+
+		value.Field(i).Set(reflect.ValueOf(r))
+	}
+
+	return nil
+}
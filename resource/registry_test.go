@@ -0,0 +1,78 @@
+package resource
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iakinsey/delver/config"
+)
+
+type testStore interface {
+	Get() string
+}
+
+type memoryStore struct{}
+
+func (s *memoryStore) Get() string {
+	return "value"
+}
+
+type testParams struct {
+	Path             string      `json:"path"`
+	Store            testStore   `json:"-" resource:"store"`
+	TransformerQueue interface{} `json:"-" resource:"transformer_queue"`
+	Cache            testStore   `json:"-" resource:"cache,optional"`
+}
+
+func TestRegistry(t *testing.T) {
+	Register("test_resource", Factory{
+		Params: func(conf config.Resource) interface{} { return &testParams{Path: conf.Name} },
+		New: func(params interface{}) interface{} {
+			return params.(*testParams).Path
+		},
+	})
+
+	factory, params, err := ParseResource(config.Resource{Name: "default", Type: "test_resource"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "default", factory.New(params))
+	assert.Contains(t, Types(), "test_resource")
+
+	_, _, err = ParseResource(config.Resource{Name: "unknown", Type: "unknown"})
+
+	assert.Error(t, err)
+}
+
+func TestBind(t *testing.T) {
+	data := json.RawMessage(`{"path": "/tmp", "store": "urls"}`)
+	store := &memoryStore{}
+	resources := map[string]interface{}{
+		"urls":                      store,
+		config.TransformerQueueName: "queue",
+	}
+
+	refs, err := References(data, &testParams{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"store": "urls", "transformer_queue": "transformer_queue"}, refs)
+
+	params := &testParams{}
+
+	assert.NoError(t, Bind(data, params, resources))
+	assert.Equal(t, "/tmp", params.Path)
+	assert.Equal(t, store, params.Store)
+	assert.Equal(t, "queue", params.TransformerQueue)
+	assert.Nil(t, params.Cache)
+
+	params = &testParams{}
+
+	assert.NoError(t, Bind(json.RawMessage(`{"store": "urls", "cache": "urls"}`), params, resources))
+	assert.Equal(t, store, params.Cache)
+
+	// Missing references, undefined resources and mismatched types are errors
+	assert.Error(t, Bind(json.RawMessage(`{}`), &testParams{}, resources))
+	assert.Error(t, Bind(json.RawMessage(`{"store": "missing"}`), &testParams{}, resources))
+	assert.Error(t, Bind(json.RawMessage(`{"store": "transformer_queue"}`), &testParams{}, resources))
+}
@@ -0,0 +1,123 @@
+package topology
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Node IDs contain characters neither format allows unquoted, so nodes are
+// written as n0, n1 and so on in graph order
+func (s Graph) aliases() map[string]string {
+	aliases := make(map[string]string)
+
+	for i, node := range s.Nodes {
+		aliases[node.ID] = fmt.Sprintf("n%d", i)
+	}
+
+	return aliases
+}
+
+// Lines shown for a node: its name, type and any live annotations
+func (s Node) lines() []string {
+	lines := []string{s.Name, s.Type}
+
+	if s.Length != nil {
+		lines = append(lines, fmt.Sprintf("length %d", *s.Length))
+	}
+
+	if s.Counters != nil {
+		lines = append(lines, fmt.Sprintf(
+			"success %d error %d",
+			int64(s.Counters["success"]),
+			int64(s.Counters["error"]),
+		))
+	}
+
+	return lines
+}
+
+var dotShapes = map[string]string{
+	KindWorker:   "box",
+	KindQueue:    "cylinder",
+	KindResource: "note",
+}
+
+// Renders the graph in Graphviz DOT. Go quoting escapes quotes and newlines
+// the way DOT reads them.
+func (s Graph) DOT() string {
+	var b strings.Builder
+	aliases := s.aliases()
+
+	b.WriteString("digraph delver {\n\trankdir=LR;\n")
+
+	for _, node := range s.Nodes {
+		fmt.Fprintf(
+			&b, "\t%s [label=%s shape=%s];\n",
+			aliases[node.ID], strconv.Quote(strings.Join(node.lines(), "\n")), dotShapes[node.Kind],
+		)
+	}
+
+	for _, edge := range s.Edges {
+		fmt.Fprintf(&b, "\t%s -> %s", aliases[edge.From], aliases[edge.To])
+
+		if edge.Label != "" {
+			fmt.Fprintf(&b, " [label=%s]", strconv.Quote(edge.Label))
+		}
+
+		b.WriteString(";\n")
+	}
+
+	b.WriteString("}\n")
+
+	return b.String()
+}
+
+var mermaidShapes = map[string][2]string{
+	KindWorker:   {"[", "]"},
+	KindQueue:    {"[(", ")]"},
+	KindResource: {"{{", "}}"},
+}
+
+// Renders the graph as a Mermaid flowchart
+func (s Graph) Mermaid() string {
+	var b strings.Builder
+	aliases := s.aliases()
+
+	b.WriteString("flowchart LR\n")
+
+	for _, node := range s.Nodes {
+		shape := mermaidShapes[node.Kind]
+		lines := make([]string, 0)
+
+		for _, line := range node.lines() {
+			lines = append(lines, mermaidEscape(line))
+		}
+
+		fmt.Fprintf(
+			&b, "\t%s%s\"%s\"%s\n",
+			aliases[node.ID], shape[0], strings.Join(lines, "<br/>"), shape[1],
+		)
+	}
+
+	for _, edge := range s.Edges {
+		if edge.Label == "" {
+			fmt.Fprintf(&b, "\t%s --> %s\n", aliases[edge.From], aliases[edge.To])
+		} else {
+			fmt.Fprintf(&b, "\t%s -->|\"%s\"| %s\n", aliases[edge.From], mermaidEscape(edge.Label), aliases[edge.To])
+		}
+	}
+
+	return b.String()
+}
+
+// Mermaid labels take HTML entities rather than backslash escapes
+var mermaidEscaper = strings.NewReplacer(
+	`"`, "#quot;",
+	"<", "#lt;",
+	">", "#gt;",
+)
+
+func mermaidEscape(s string) string {
+	return mermaidEscaper.Replace(s)
+}
@@ -0,0 +1,215 @@
+package topology
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/instrument"
+	"github.com/iakinsey/delver/queue"
+	"github.com/iakinsey/delver/resource"
+	"github.com/iakinsey/delver/worker"
+)
+
+const (
+	KindWorker   = "worker"
+	KindQueue    = "queue"
+	KindResource = "resource"
+)
+
+var queueType = reflect.TypeOf((*queue.Queue)(nil)).Elem()
+
+// A worker, queue or other resource of an application
+type Node struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Set on live graphs only
+	Length   *int64             `json:"length,omitempty"`
+	Counters map[string]float32 `json:"counters,omitempty"`
+}
+
+// Messages flow from queues to workers and from workers to queues, workers
+// also point at the resources they are bound to. The label names the outbox,
+// route or resource parameter.
+type Edge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Label string `json:"label,omitempty"`
+}
+
+type Graph struct {
+	Nodes []Node `json:"nodes"`
+	Edges []Edge `json:"edges"`
+}
+
+// Describes how the workers and resources of an application connect. Parts
+// of the config that fail validation are left out rather than reported.
+func Build(app config.Application) Graph {
+	g := Graph{Nodes: []Node{}, Edges: []Edge{}}
+	resources := make(map[string]string)
+
+	for _, rc := range app.Resources {
+		if _, ok := resources[rc.Name]; ok {
+			continue
+		}
+
+		kind := KindResource
+
+		if factory, err := resource.GetFactory(rc.Type); err == nil && factory.Type != nil && factory.Type.AssignableTo(queueType) {
+			kind = KindQueue
+		}
+
+		resources[rc.Name] = nodeID(kind, rc.Name)
+		g.Nodes = append(g.Nodes, Node{
+			ID:   resources[rc.Name],
+			Kind: kind,
+			Name: rc.Name,
+			Type: rc.Type,
+		})
+	}
+
+	edge := func(from, to, label string) {
+		if from != "" && to != "" {
+			g.Edges = append(g.Edges, Edge{From: from, To: to, Label: label})
+		}
+	}
+
+	for _, wc := range app.Workers {
+		id := nodeID(KindWorker, wc.Name)
+
+		g.Nodes = append(g.Nodes, Node{
+			ID:   id,
+			Kind: KindWorker,
+			Name: wc.Name,
+			Type: wc.Type,
+		})
+
+		if wc.Manager != "job" && wc.Inbox != "" {
+			edge(resources[wc.Inbox], id, "")
+		}
+
+		if wc.Outbox != "" {
+			edge(id, resources[wc.Outbox], "outbox")
+		}
+
+		for _, rc := range wc.Routes {
+			edge(id, resources[rc.Outbox], routeLabel(rc))
+		}
+
+		if wc.ErrorOutbox != "" {
+			edge(id, resources[wc.ErrorOutbox], "errors")
+		}
+
+		refs := bindings(wc)
+
+		for _, tag := range sortedKeys(refs) {
+			edge(id, resources[refs[tag]], tag)
+		}
+	}
+
+	return g
+}
+
+// Resource names bound to the worker, keyed by parameter
+func bindings(wc config.Worker) map[string]string {
+	factory, err := worker.GetFactory(wc.Type)
+
+	if err != nil {
+		return nil
+	}
+
+	params := factory.Params()
+
+	if resource.ParseParams(wc.Parameters, params) != nil {
+		return nil
+	}
+
+	refs, err := resource.References(wc.Parameters, params)
+
+	if err != nil {
+		return nil
+	}
+
+	return refs
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func routeLabel(rc config.Route) string {
+	switch {
+	case rc.MessageType != "" && rc.Match != "":
+		return fmt.Sprintf("%s: %s", rc.MessageType, rc.Match)
+	case rc.Match != "":
+		return rc.Match
+	default:
+		return rc.MessageType
+	}
+}
+
+func nodeID(kind, name string) string {
+	return kind + ":" + name
+}
+
+// Adds current queue lengths and worker counter totals to a copy of the graph
+func Annotate(g Graph, resources map[string]interface{}) Graph {
+	nodes := make([]Node, len(g.Nodes))
+
+	for i, node := range g.Nodes {
+		switch node.Kind {
+		case KindQueue:
+			if q, ok := resources[node.Name].(queue.Queue); ok {
+				length := q.Len()
+				node.Length = &length
+			}
+		case KindWorker:
+			node.Counters = instrument.GetCounters(node.Name)
+		}
+
+		nodes[i] = node
+	}
+
+	return Graph{Nodes: nodes, Edges: g.Edges}
+}
+
+var live = struct {
+	sync.RWMutex
+	graph     *Graph
+	resources map[string]interface{}
+}{}
+
+// Makes the running application available to Live
+func Publish(app config.Application, resources map[string]interface{}) {
+	g := Build(app)
+
+	live.Lock()
+	defer live.Unlock()
+
+	live.graph = &g
+	live.resources = resources
+}
+
+// Annotated graph of the running application, false when none is running
+func Live() (Graph, bool) {
+	live.RLock()
+	defer live.RUnlock()
+
+	if live.graph == nil {
+		return Graph{}, false
+	}
+
+	return Annotate(*live.graph, live.resources), true
+}
@@ -0,0 +1,110 @@
+package topology
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/instrument"
+	"github.com/iakinsey/delver/queue"
+	_ "github.com/iakinsey/delver/resource/maps"
+	_ "github.com/iakinsey/delver/worker/accumulator"
+	_ "github.com/iakinsey/delver/worker/fetcher"
+)
+
+type lengthQueue struct {
+	queue.Queue
+	length int64
+}
+
+func (s *lengthQueue) Len() int64 {
+	return s.length
+}
+
+func newTestApplication() config.Application {
+	return config.Application{
+		Resources: []config.Resource{
+			{Name: "fetch_in", Type: "channel_queue"},
+			{Name: "accumulate_in", Type: "channel_queue"},
+			{Name: "failed", Type: "channel_queue"},
+			{Name: "urls", Type: "persistent_map"},
+		},
+		Workers: []config.Worker{
+			{
+				Name:   "fetcher",
+				Type:   "http_fetcher",
+				Inbox:  "fetch_in",
+				Outbox: "accumulate_in",
+				Routes: []config.Route{
+					{MessageType: "fetcher_response", Match: `host == "a"`, Outbox: "failed"},
+				},
+			},
+			{
+				Name:        "accumulator",
+				Type:        "dfs_basic_accumulator",
+				Inbox:       "accumulate_in",
+				Outbox:      "fetch_in",
+				ErrorOutbox: "failed",
+				Parameters:  json.RawMessage(`{"url_store": "urls", "visited_urls": "missing"}`),
+			},
+		},
+	}
+}
+
+func TestBuild(t *testing.T) {
+	g := Build(newTestApplication())
+
+	assert.Equal(t, []Node{
+		{ID: "queue:fetch_in", Kind: KindQueue, Name: "fetch_in", Type: "channel_queue"},
+		{ID: "queue:accumulate_in", Kind: KindQueue, Name: "accumulate_in", Type: "channel_queue"},
+		{ID: "queue:failed", Kind: KindQueue, Name: "failed", Type: "channel_queue"},
+		{ID: "resource:urls", Kind: KindResource, Name: "urls", Type: "persistent_map"},
+		{ID: "worker:fetcher", Kind: KindWorker, Name: "fetcher", Type: "http_fetcher"},
+		{ID: "worker:accumulator", Kind: KindWorker, Name: "accumulator", Type: "dfs_basic_accumulator"},
+	}, g.Nodes)
+
+	// Undefined resources are left out
+	assert.Equal(t, []Edge{
+		{From: "queue:fetch_in", To: "worker:fetcher"},
+		{From: "worker:fetcher", To: "queue:accumulate_in", Label: "outbox"},
+		{From: "worker:fetcher", To: "queue:failed", Label: `fetcher_response: host == "a"`},
+		{From: "queue:accumulate_in", To: "worker:accumulator"},
+		{From: "worker:accumulator", To: "queue:fetch_in", Label: "outbox"},
+		{From: "worker:accumulator", To: "queue:failed", Label: "errors"},
+		{From: "worker:accumulator", To: "resource:urls", Label: "url_store"},
+	}, g.Edges)
+}
+
+func TestRender(t *testing.T) {
+	g := Build(newTestApplication())
+	g = Annotate(g, map[string]interface{}{"fetch_in": &lengthQueue{length: 1}})
+
+	dot := g.DOT()
+
+	assert.Contains(t, dot, "n0 [label=\"fetch_in\\nchannel_queue\\nlength 1\" shape=cylinder];\n")
+	assert.Contains(t, dot, "n4 [label=\"fetcher\\nhttp_fetcher\\nsuccess 0 error 0\" shape=box];\n")
+	assert.Contains(t, dot, "n4 -> n2 [label=\"fetcher_response: host == \\\"a\\\"\"];\n")
+	assert.Contains(t, dot, "n5 -> n3 [label=\"url_store\"];\n")
+
+	mermaid := g.Mermaid()
+
+	assert.Contains(t, mermaid, "n0[(\"fetch_in<br/>channel_queue<br/>length 1\")]\n")
+	assert.Contains(t, mermaid, "n3{{\"urls<br/>persistent_map\"}}\n")
+	assert.Contains(t, mermaid, "n0 --> n4\n")
+	assert.Contains(t, mermaid, "n4 -->|\"fetcher_response: host == #quot;a#quot;\"| n2\n")
+}
+
+func TestAnnotateCounters(t *testing.T) {
+	before := Annotate(Build(newTestApplication()), nil).Nodes[5].Counters
+
+	instrument.GetMetrics().IncrCounter([]string{"accumulator", "success"}, 1)
+	instrument.GetMetrics().IncrCounter([]string{"accumulator", "error"}, 2)
+
+	g := Annotate(Build(newTestApplication()), nil)
+	label := fmt.Sprintf("success %d error %d", int64(before["success"])+1, int64(before["error"])+2)
+
+	assert.Contains(t, g.DOT(), "n5 [label=\"accumulator\\ndfs_basic_accumulator\\n"+label+"\" shape=box];\n")
+}
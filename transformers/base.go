@@ -1,8 +1,6 @@
 package transformers
 
 import (
-	"encoding/json"
-
 	"github.com/iakinsey/delver/queue"
 	"github.com/iakinsey/delver/types"
 	"github.com/pkg/errors"
@@ -10,7 +8,8 @@ import (
 )
 
 type Transformer interface {
-	Perform(msg json.RawMessage) ([]*types.Indexable, error)
+	// Receives the decoded payload of an Input message
+	Perform(msg interface{}) ([]*types.Indexable, error)
 	Input() types.MessageType
 	Streamable() bool
 	Name() string
@@ -29,12 +28,12 @@ func GetTransformer(name string) Transformer {
 	return nil
 }
 
-func Send(q queue.Queue, id string, msgType types.MessageType, data interface{}) error {
+func Send(q queue.Queue, id string, data interface{}) error {
 	if q == nil {
 		return nil
 	}
 
-	b, err := json.Marshal(data)
+	msgType, b, err := types.EncodeMessage(data)
 
 	if err != nil {
 		return errors.Wrap(err, "failed to serialize transformer message")
@@ -47,7 +46,7 @@ func Send(q queue.Queue, id string, msgType types.MessageType, data interface{})
 	transformerMsg := types.Message{
 		ID:          id,
 		MessageType: msgType,
-		Message:     json.RawMessage(b),
+		Message:     b,
 	}
 
 	return errors.Wrap(
@@ -1,11 +1,10 @@
 package transformers
 
 import (
-	"encoding/json"
+	"fmt"
 
 	"github.com/iakinsey/delver/types"
 	"github.com/iakinsey/delver/types/message"
-	"github.com/pkg/errors"
 )
 
 type compositeTransformer struct{}
@@ -14,12 +13,15 @@ func NewCompositeTransformer() Transformer {
 	return &compositeTransformer{}
 }
 
-func (s *compositeTransformer) Perform(msg json.RawMessage) ([]*types.Indexable, error) {
-	var composite message.CompositeAnalysis
+func (s *compositeTransformer) Perform(msg interface{}) ([]*types.Indexable, error) {
 	var results []*types.Indexable
 
-	if err := json.Unmarshal(msg, &composite); err != nil {
-		return nil, errors.Wrap(err, "transformer failed to parse metrics")
+	composite, ok := msg.(message.CompositeAnalysis)
+
+	if !ok {
+		return nil, fmt.Errorf("composite transformer received %T", msg)
+	} else if composite.NotModified {
+		return nil, nil
 	}
 
 	results = append(results, &types.Indexable{
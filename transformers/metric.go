@@ -1,10 +1,9 @@
 package transformers
 
 import (
-	"encoding/json"
+	"fmt"
 
 	"github.com/iakinsey/delver/types"
-	"github.com/pkg/errors"
 )
 
 type metricTransformer struct{}
@@ -13,12 +12,13 @@ func NewMetricTransformer() Transformer {
 	return &metricTransformer{}
 }
 
-func (s *metricTransformer) Perform(msg json.RawMessage) ([]*types.Indexable, error) {
-	var metrics []types.Metric
+func (s *metricTransformer) Perform(msg interface{}) ([]*types.Indexable, error) {
 	var results []*types.Indexable
 
-	if err := json.Unmarshal(msg, &metrics); err != nil {
-		return nil, errors.Wrap(err, "transformer failed to parse metrics")
+	metrics, ok := msg.([]types.Metric)
+
+	if !ok {
+		return nil, fmt.Errorf("metric transformer received %T", msg)
 	}
 
 	for _, m := range metrics {
@@ -10,4 +10,5 @@ const (
 	NgramField       string = "ngram"
 	UrlField         string = "url"
 	TitleField       string = "title"
+	CanonicalField   string = "canonical"
 )
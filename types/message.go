@@ -2,18 +2,71 @@ package types
 
 import (
 	"encoding/json"
+
+	"github.com/iakinsey/delver/codec"
 )
 
 type Message struct {
-	ID          string          `json:"id"`
-	MessageType MessageType     `json:"message_type"`
-	Message     json.RawMessage `json:"message"`
+	ID          string      `json:"id"`
+	MessageType MessageType `json:"message_type"`
+	Message     Payload     `json:"message"`
+	// Failed processing attempts, carried across delayed re-enqueues
+	Attempts int     `json:"attempts,omitempty"`
+	Headers  Headers `json:"headers,omitempty"`
+	// Set by queues that hand messages out under a claim, so ending the
+	// transaction of a claim that has since expired can be told apart
+	Claim uint64 `json:"-"`
+}
+
+// A message payload as written by its codec. Written into JSON, a payload
+// from a binary codec is converted to plain JSON rather than copied, so
+// messages can move between queues using different codecs.
+type Payload []byte
+
+func (s Payload) MarshalJSON() ([]byte, error) {
+	if len(s) == 0 {
+		return []byte("null"), nil
+	}
+
+	return codec.ToJSON(s)
+}
+
+func (s *Payload) UnmarshalJSON(data []byte) error {
+	*s = append((*s)[0:0], data...)
+
+	return nil
+}
+
+// Lineage of a message, carried from each consumed message to the messages
+// published in response
+type Headers struct {
+	// Shared by every message descending from the same root
+	TraceID string `json:"trace_id,omitempty"`
+	// URI of the seed request the trace started from
+	Seed string `json:"seed,omitempty"`
+	// Unix milliseconds
+	CreatedAt int64 `json:"created_at,omitempty"`
+	// Number of workers the trace passed through before this message
+	Hops int `json:"hops,omitempty"`
+	// Configured name of the worker that published the message
+	Producer string            `json:"producer,omitempty"`
+	User     map[string]string `json:"user,omitempty"`
 }
 
 type MultiMessage struct {
 	Values []interface{}
 }
 
+// Lets a worker attach user headers to a published value
+type HeaderedMessage struct {
+	Value   interface{}
+	Headers map[string]string
+}
+
+func WithHeaders(value interface{}, headers map[string]string) HeaderedMessage {
+	return HeaderedMessage{Value: value, Headers: headers}
+}
+
 func NewMessage(in interface{}, t MessageType) (Message, error) {
 	jsonMessage, err := json.Marshal(in)
 
@@ -24,6 +77,6 @@ func NewMessage(in interface{}, t MessageType) (Message, error) {
 	return Message{
 		ID:          "0-0-0-TestName",
 		MessageType: t,
-		Message:     json.RawMessage(jsonMessage),
+		Message:     Payload(jsonMessage),
 	}, nil
 }
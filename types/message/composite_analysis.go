@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"reflect"
+
+	"github.com/iakinsey/delver/types/features"
 )
 
 type CompositeAnalysis struct {
@@ -31,6 +33,18 @@ func (s *CompositeAnalysis) Load(key string, val interface{}) error {
 	return nil
 }
 
+// The page's declared canonical URI, falling back to where it was fetched
+// from
+func (s *CompositeAnalysis) CanonicalURI() string {
+	var canonical features.Canonical
+
+	if s.LoadPermissive(features.CanonicalField, &canonical) && canonical != "" {
+		return string(canonical)
+	}
+
+	return s.BaseURI()
+}
+
 func (s *CompositeAnalysis) LoadPermissive(key string, val interface{}) bool {
 	feature, ok := s.Features[key]
 
@@ -9,4 +9,12 @@ type FetcherRequest struct {
 	Origin    string         `json:"origin,omitempty"`
 	Protocol  types.Protocol `json:"protocol,omitempty"`
 	Depth     int            `json:"depth,omitempty"`
+	// Defaults to GET
+	Method  string              `json:"method,omitempty"`
+	Headers map[string][]string `json:"headers,omitempty"`
+	// Sent as is, or Form is sent url encoded when Body is empty
+	Body string              `json:"body,omitempty"`
+	Form map[string][]string `json:"form,omitempty"`
+	// Credential profile from the http client config
+	Profile string `json:"profile,omitempty"`
 }
@@ -2,6 +2,12 @@ package message
 
 import "github.com/iakinsey/delver/types"
 
+// Reasons a stored body may be cut short
+const (
+	TruncatedMaxBodySize     = "max_body_size"
+	TruncatedTransferTimeout = "transfer_timeout"
+)
+
 type FetcherResponse struct {
 	FetcherRequest
 
@@ -13,4 +19,31 @@ type FetcherResponse struct {
 	Success       bool                `json:"success,omitempty"`
 	Timestamp     int64               `json:"timestamp,omitempty"`
 	Header        map[string][]string `json:"header,omitempty"`
+	// The server reported no change since the last fetch, nothing is stored
+	// and ContentMD5 is carried over
+	NotModified bool `json:"not_modified,omitempty"`
+	// The content differs from the last fetch
+	ContentChanged bool `json:"content_changed,omitempty"`
+	// Bytes stored, less than the full body when TruncatedReason is set
+	BodySize        int64  `json:"body_size,omitempty"`
+	Truncated       bool   `json:"truncated,omitempty"`
+	TruncatedReason string `json:"truncated_reason,omitempty"`
+	// Redirects followed in order, and the URI the response came from
+	Redirects []Redirect `json:"redirects,omitempty"`
+	FinalURI  string     `json:"final_uri,omitempty"`
+}
+
+// A URI that answered with a redirect
+type Redirect struct {
+	URI      string `json:"uri"`
+	HTTPCode int    `json:"http_code"`
+}
+
+// The URI the content came from, which relative links resolve against
+func (s *FetcherResponse) BaseURI() string {
+	if s.FinalURI != "" {
+		return s.FinalURI
+	}
+
+	return s.URI
 }
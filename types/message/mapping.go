@@ -1,20 +1,23 @@
 package message
 
 import (
-	"fmt"
-
 	"github.com/iakinsey/delver/types"
 )
 
-func GetMessageTypeMapping(msg interface{}) (types.MessageType, error) {
-	switch msg.(type) {
-	case FetcherRequest:
-		return types.FetcherRequestType, nil
-	case FetcherResponse:
-		return types.FetcherResponseType, nil
-	case CompositeAnalysis:
-		return types.CompositeAnalysisType, nil
-	default:
-		return types.NullMessage, fmt.Errorf("unmappable message type: %s", msg)
-	}
+func init() {
+	types.RegisterMessageType(types.MessageTypeInfo{
+		Type:      types.FetcherRequestType,
+		Name:      "fetcher_request",
+		Prototype: FetcherRequest{},
+	})
+	types.RegisterMessageType(types.MessageTypeInfo{
+		Type:      types.FetcherResponseType,
+		Name:      "fetcher_response",
+		Prototype: FetcherResponse{},
+	})
+	types.RegisterMessageType(types.MessageTypeInfo{
+		Type:      types.CompositeAnalysisType,
+		Name:      "composite_analysis",
+		Prototype: CompositeAnalysis{},
+	})
 }
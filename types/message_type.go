@@ -1,12 +1,184 @@
 package types
 
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iakinsey/delver/codec"
+)
+
 type MessageType int32
 
+// Built-in message types. The numbers are the wire ids written into queued
+// messages, so they are spelled out rather than left to iota: an id never
+// changes, and once a type is removed its id is retired rather than reused.
+// New types register with an id no other type has ever had.
 const (
-	NullMessage MessageType = iota
-	FetcherRequestType
-	FetcherResponseType
-	CompositeAnalysisType
-	TimerType
-	MetricType
+	NullMessage           MessageType = 0
+	FetcherRequestType    MessageType = 1
+	FetcherResponseType   MessageType = 2
+	CompositeAnalysisType MessageType = 3
+	TimerType             MessageType = 4
+	MetricType            MessageType = 5
 )
+
+var ErrUnknownMessageType = errors.New("unknown message type")
+
+// Binds a message type to the name used in configs, the Go type its payload
+// decodes into and, optionally, a codec used instead of the configured one
+type MessageTypeInfo struct {
+	Type MessageType
+	Name string
+	// Any value of the payload type, nil for types that are never published
+	Prototype interface{}
+	Codec     *codec.Codec
+}
+
+type messageTypeRegistry struct {
+	sync.RWMutex
+	byType   map[MessageType]MessageTypeInfo
+	byName   map[string]MessageType
+	byGoType map[reflect.Type]MessageType
+}
+
+var messageTypes = messageTypeRegistry{
+	byType:   make(map[MessageType]MessageTypeInfo),
+	byName:   make(map[string]MessageType),
+	byGoType: make(map[reflect.Type]MessageType),
+}
+
+// Built-ins with payloads defined in types/message are registered there
+func init() {
+	RegisterMessageType(MessageTypeInfo{Type: NullMessage, Name: "null"})
+	RegisterMessageType(MessageTypeInfo{Type: TimerType, Name: "timer", Prototype: int64(0)})
+	RegisterMessageType(MessageTypeInfo{Type: MetricType, Name: "metric", Prototype: []Metric{}})
+}
+
+// Registering a wire id, name or payload type twice is a programming error
+// and stops the process, two types sharing an id would decode each other's
+// queued messages
+func RegisterMessageType(info MessageTypeInfo) {
+	messageTypes.Lock()
+	defer messageTypes.Unlock()
+
+	if existing, ok := messageTypes.byType[info.Type]; ok {
+		log.Fatalf("message type id %d registered twice, by %q and %q", int32(info.Type), existing.Name, info.Name)
+	} else if _, ok := messageTypes.byName[info.Name]; ok || info.Name == "" {
+		log.Fatalf("invalid or duplicate message type name %q", info.Name)
+	}
+
+	if info.Prototype != nil {
+		goType := reflect.TypeOf(info.Prototype)
+
+		if _, ok := messageTypes.byGoType[goType]; ok {
+			log.Fatalf("payload type %s registered to two message types", goType)
+		}
+
+		messageTypes.byGoType[goType] = info.Type
+	}
+
+	messageTypes.byType[info.Type] = info
+	messageTypes.byName[info.Name] = info.Type
+}
+
+func GetMessageTypeInfo(t MessageType) (MessageTypeInfo, error) {
+	messageTypes.RLock()
+	defer messageTypes.RUnlock()
+
+	if info, ok := messageTypes.byType[t]; ok {
+		return info, nil
+	}
+
+	return MessageTypeInfo{}, errors.Wrapf(ErrUnknownMessageType, "message_type(%d)", int32(t))
+}
+
+// Looks up the message type a payload value, or a pointer to one, is
+// published as
+func GetMessageTypeOf(value interface{}) (MessageType, error) {
+	messageTypes.RLock()
+	defer messageTypes.RUnlock()
+
+	goType := reflect.TypeOf(value)
+
+	if t, ok := messageTypes.byGoType[goType]; ok {
+		return t, nil
+	} else if goType != nil && goType.Kind() == reflect.Ptr {
+		if t, ok := messageTypes.byGoType[goType.Elem()]; ok {
+			return t, nil
+		}
+	}
+
+	return NullMessage, errors.Wrapf(ErrUnknownMessageType, "payload %T", value)
+}
+
+func (t MessageType) String() string {
+	if info, err := GetMessageTypeInfo(t); err == nil {
+		return info.Name
+	}
+
+	return fmt.Sprintf("message_type(%d)", int32(t))
+}
+
+// Looks up a message type by the name used in configs
+func ParseMessageType(name string) (MessageType, error) {
+	messageTypes.RLock()
+	defer messageTypes.RUnlock()
+
+	if t, ok := messageTypes.byName[name]; ok {
+		return t, nil
+	}
+
+	return NullMessage, errors.Wrapf(ErrUnknownMessageType, "%s", name)
+}
+
+// Returns a pointer to an empty value of the payload type of a message type
+func NewMessageOfType(t MessageType) (interface{}, error) {
+	info, err := GetMessageTypeInfo(t)
+
+	if err != nil {
+		return nil, err
+	} else if info.Prototype == nil {
+		return nil, fmt.Errorf("message type %s has no payload", info.Name)
+	}
+
+	return reflect.New(reflect.TypeOf(info.Prototype)).Interface(), nil
+}
+
+// Serializes a payload with the codec of its message type
+func EncodeMessage(value interface{}) (MessageType, Payload, error) {
+	t, err := GetMessageTypeOf(value)
+
+	if err != nil {
+		return t, nil, err
+	}
+
+	info, _ := GetMessageTypeInfo(t)
+	c := codec.Get()
+
+	if info.Codec != nil {
+		c = *info.Codec
+	}
+
+	b, err := c.MarshalPayload(value)
+
+	return t, Payload(b), errors.Wrapf(err, "failed to serialize %s message", info.Name)
+}
+
+// Deserializes the payload of a message into a value of its registered type
+func DecodeMessage(message Message) (interface{}, error) {
+	value, err := NewMessageOfType(message.MessageType)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := codec.Unmarshal(message.Message, value); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s message", message.MessageType)
+	}
+
+	return reflect.ValueOf(value).Elem().Interface(), nil
+}
@@ -0,0 +1,52 @@
+package types
+
+import (
+	"encoding/json"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iakinsey/delver/codec"
+	"github.com/iakinsey/delver/config"
+)
+
+func TestRegisterMessageTypeDuplicateID(t *testing.T) {
+	exit := log.StandardLogger().ExitFunc
+	defer func() { log.StandardLogger().ExitFunc = exit }()
+
+	log.StandardLogger().ExitFunc = func(int) { panic("exit") }
+
+	assert.Panics(t, func() {
+		RegisterMessageType(MessageTypeInfo{Type: TimerType, Name: "other_timer"})
+	})
+
+	_, err := ParseMessageType("other_timer")
+
+	assert.ErrorIs(t, err, ErrUnknownMessageType)
+	assert.Equal(t, "timer", TimerType.String())
+}
+
+func TestPayloadWrittenAsJSON(t *testing.T) {
+	msgpack, err := codec.New(config.CodecConfig{Format: "msgpack"})
+
+	assert.NoError(t, err)
+
+	payload, err := msgpack.MarshalPayload(int64(42))
+
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(Message{ID: "0", MessageType: TimerType, Message: payload})
+
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id": "0", "message_type": 4, "message": 42, "headers": {}}`, string(b))
+
+	var msg Message
+
+	assert.NoError(t, json.Unmarshal(b, &msg))
+
+	value, err := DecodeMessage(msg)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), value)
+}
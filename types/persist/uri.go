@@ -18,7 +18,15 @@ type URI struct {
 }
 
 func CompositeToParquetURI(composite message.CompositeAnalysis) (io.Reader, error) {
-	uri := URI(composite.FetcherRequest)
+	req := composite.FetcherRequest
+	uri := URI{
+		RequestID: req.RequestID,
+		URI:       req.URI,
+		Host:      req.Host,
+		Origin:    req.Origin,
+		Protocol:  req.Protocol,
+		Depth:     req.Depth,
+	}
 
 	return util.ToParquet(string(composite.RequestID), URIParquetSchema, uri)
 }
@@ -0,0 +1,12 @@
+package rpc
+
+// Format is one of json, dot or mermaid, defaulting to json
+type TopologyRequest struct {
+	Format string `json:"format"`
+}
+
+// Rendered topology for formats other than json
+type TopologyResponse struct {
+	Format string `json:"format"`
+	Source string `json:"source"`
+}
@@ -1,8 +1,11 @@
 package util
 
 import (
+	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
 
 	"github.com/iakinsey/delver/config"
 	log "github.com/sirupsen/logrus"
@@ -14,23 +17,42 @@ const defaultUserAgent = "delver"
 
 type DelverHTTPClient interface {
 	Perform(url string) (*http.Response, error)
+	// Sends a prepared request after applying the named credential profile,
+	// if any, and the profiles of the request host. Only GET and HEAD
+	// requests are retried.
+	PerformRequest(req *http.Request, profile string) (*http.Response, error)
 }
 
 type delverHTTPClient struct {
 	HTTP       *http.Client
 	UserAgent  string
 	MaxRetries int
+	Profiles   map[string]config.HTTPProfile
 }
 
 // TODO use a mocking library if this becomes a common pattern
 type MockDelverHTTPClient struct {
 	Response *http.Response
 	Error    error
+	// Last request performed and the profile it named
+	Request *http.Request
+	Profile string
 }
 
 func NewHTTPClient() DelverHTTPClient {
 	params := config.Get().HTTPClient
-	client := &http.Client{Timeout: params.Timeout}
+	client := &http.Client{
+		Timeout: params.Timeout,
+		// The last redirect response is returned once the limit is reached,
+		// its request links back through every hop
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > params.MaxRedirects {
+				return http.ErrUseLastResponse
+			}
+
+			return nil
+		},
+	}
 
 	if params.Socks5Url != "" {
 		dialer, err := proxy.SOCKS5("tcp", params.Socks5Url, nil, proxy.Direct)
@@ -60,30 +82,53 @@ func NewHTTPClient() DelverHTTPClient {
 		HTTP:       client,
 		UserAgent:  params.UserAgent,
 		MaxRetries: params.MaxRetries,
+		Profiles:   params.Profiles,
 	}
 }
 
 func (s *delverHTTPClient) Perform(url string) (*http.Response, error) {
-	var req *http.Request
+	req, err := http.NewRequest("GET", url, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.PerformRequest(req, "")
+}
+
+func (s *delverHTTPClient) PerformRequest(req *http.Request, profile string) (*http.Response, error) {
 	var resp *http.Response
 	var err error
 
-	for i := 0; i < s.MaxRetries+1; i++ {
-		req, err = http.NewRequest("GET", url, nil)
+	if err := s.applyProfiles(req, profile); err != nil {
+		return nil, err
+	}
 
-		if err != nil {
-			return nil, err
-		}
+	if req.Header.Get("User-Agent") == "" && s.UserAgent != "" {
+		req.Header.Set("User-Agent", s.UserAgent)
+	} else if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", defaultUserAgent)
+	}
 
-		if s.UserAgent != "" {
-			req.Header.Set("User-Agent", s.UserAgent)
-		} else {
-			req.Header.Set("User-Agent", defaultUserAgent)
+	attempts := s.MaxRetries + 1
+
+	// Requests that may change something on the server are sent once
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		attempts = 1
+	}
+
+	for i := 0; i < attempts; i++ {
+		// Bodies are consumed by each attempt
+		if i > 0 && req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
 		}
 
 		resp, err = s.HTTP.Do(req)
 
-		if err == nil {
+		// A cancelled request fails the same way every time
+		if err == nil || req.Context().Err() != nil {
 			break
 		}
 	}
@@ -91,6 +136,85 @@ func (s *delverHTTPClient) Perform(url string) (*http.Response, error) {
 	return resp, err
 }
 
+// The named profile is applied first, so it wins over host profiles, which
+// are applied in name order
+func (s *delverHTTPClient) applyProfiles(req *http.Request, profile string) error {
+	if profile != "" {
+		p, ok := s.Profiles[profile]
+
+		if !ok {
+			return fmt.Errorf("unknown http profile %s", profile)
+		}
+
+		applyHTTPProfile(req, p)
+	}
+
+	var names []string
+
+	for name := range s.Profiles {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name != profile && profileMatchesHost(s.Profiles[name], req.URL.Hostname()) {
+			applyHTTPProfile(req, s.Profiles[name])
+		}
+	}
+
+	return nil
+}
+
+func profileMatchesHost(profile config.HTTPProfile, host string) bool {
+	for _, h := range profile.Hosts {
+		if strings.EqualFold(host, h) || strings.HasSuffix(strings.ToLower(host), "."+strings.ToLower(h)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Adds the headers, cookies and credentials of a profile that the request
+// does not already have
+func applyHTTPProfile(req *http.Request, profile config.HTTPProfile) {
+	for key, val := range profile.Headers {
+		if req.Header.Get(key) == "" {
+			req.Header.Set(key, val)
+		}
+	}
+
+	for name, val := range profile.Cookies {
+		if _, err := req.Cookie(name); err == http.ErrNoCookie {
+			req.AddCookie(&http.Cookie{Name: name, Value: val})
+		}
+	}
+
+	if req.Header.Get("Authorization") != "" {
+		return
+	}
+
+	if profile.BasicAuth != nil {
+		req.SetBasicAuth(profile.BasicAuth.Username, profile.BasicAuth.Password)
+	} else if profile.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+profile.BearerToken)
+	}
+}
+
 func (s *MockDelverHTTPClient) Perform(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.PerformRequest(req, "")
+}
+
+func (s *MockDelverHTTPClient) PerformRequest(req *http.Request, profile string) (*http.Response, error) {
+	s.Request = req
+	s.Profile = profile
+
 	return s.Response, s.Error
 }
@@ -0,0 +1,104 @@
+package util
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iakinsey/delver/config"
+)
+
+func TestHTTPClientProfiles(t *testing.T) {
+	var received *http.Request
+	var body string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		received, body = r, string(b)
+	}))
+	defer server.Close()
+
+	client := &delverHTTPClient{
+		HTTP: server.Client(),
+		Profiles: map[string]config.HTTPProfile{
+			"named": {
+				Headers:     map[string]string{"X-Profile": "named"},
+				BearerToken: "token",
+			},
+			"local": {
+				Hosts:     []string{"127.0.0.1"},
+				Headers:   map[string]string{"X-Profile": "host", "X-Host": "yes"},
+				Cookies:   map[string]string{"session": "abc"},
+				BasicAuth: &config.BasicAuth{Username: "user", Password: "pass"},
+			},
+		},
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("body"))
+	_, err := client.PerformRequest(req, "named")
+
+	// The named profile wins over the host profile
+	assert.NoError(t, err)
+	assert.Equal(t, "body", body)
+	assert.Equal(t, "named", received.Header.Get("X-Profile"))
+	assert.Equal(t, "yes", received.Header.Get("X-Host"))
+	assert.Equal(t, "Bearer token", received.Header.Get("Authorization"))
+	assert.Equal(t, defaultUserAgent, received.Header.Get("User-Agent"))
+
+	cookie, err := received.Cookie("session")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", cookie.Value)
+
+	req, _ = http.NewRequest(http.MethodGet, server.URL, nil)
+	_, err = client.PerformRequest(req, "")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "host", received.Header.Get("X-Profile"))
+
+	username, password, _ := received.BasicAuth()
+
+	assert.Equal(t, "user", username)
+	assert.Equal(t, "pass", password)
+
+	req, _ = http.NewRequest(http.MethodGet, server.URL, nil)
+	_, err = client.PerformRequest(req, "missing")
+
+	assert.Error(t, err)
+}
+
+type failingTransport struct {
+	attempts int
+}
+
+func (s *failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	s.attempts++
+
+	return nil, errors.New("connection reset")
+}
+
+func TestHTTPClientRetries(t *testing.T) {
+	transport := &failingTransport{}
+	client := &delverHTTPClient{
+		HTTP:       &http.Client{Transport: transport},
+		MaxRetries: 2,
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	_, err := client.PerformRequest(req, "")
+
+	assert.Error(t, err)
+	assert.Equal(t, 3, transport.attempts)
+
+	transport.attempts = 0
+	req, _ = http.NewRequest(http.MethodPost, "http://example.com", strings.NewReader("body"))
+	_, err = client.PerformRequest(req, "")
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, transport.attempts)
+}
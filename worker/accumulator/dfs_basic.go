@@ -8,6 +8,7 @@ import (
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/iakinsey/delver/codec"
 	"github.com/iakinsey/delver/resource/bloom"
 	"github.com/iakinsey/delver/resource/maps"
 	"github.com/iakinsey/delver/types"
@@ -29,6 +30,17 @@ type DfsBasicAccumulatorParams struct {
 	MaxDepth    int               `json:"max_depth"`
 }
 
+func init() {
+	worker.Register("dfs_basic_accumulator", worker.Factory{
+		Params: func() interface{} { return &DfsBasicAccumulatorParams{} },
+		New: func(params interface{}) worker.Worker {
+			return NewDfsBasicAccumulator(*params.(*DfsBasicAccumulatorParams))
+		},
+		Accepts: []types.MessageType{types.CompositeAnalysisType},
+		Emits:   []types.MessageType{types.FetcherRequestType},
+	})
+}
+
 func NewDfsBasicAccumulator(params DfsBasicAccumulatorParams) worker.Worker {
 	return &dfsBasicAccumulator{
 		urlStore:    params.UrlStore,
@@ -41,12 +53,25 @@ func (s *dfsBasicAccumulator) OnMessage(msg types.Message) (interface{}, error)
 	var URIs features.URIs
 	composite := message.CompositeAnalysis{}
 
-	if err := json.Unmarshal(msg.Message, &composite); err != nil {
+	if err := codec.Unmarshal(msg.Message, &composite); err != nil {
 		return nil, err
 	}
 
+	// Another URL of the same page has already been crawled or queued
+	if canonical := composite.CanonicalURI(); canonical != composite.URI && s.visitedUrls.ContainsString(canonical) {
+		log.Printf("skipping %s, duplicate of %s", composite.URI, canonical)
+		s.markVisited(composite)
+
+		return nil, nil
+	}
+
 	s.markVisited(composite)
 
+	// Its links were followed on the previous visit
+	if composite.NotModified {
+		return nil, nil
+	}
+
 	if err := composite.Load(features.UrlField, &URIs); err != nil {
 		return nil, errors.Wrap(err, "dfs basic accumulator")
 	}
@@ -58,8 +83,18 @@ func (s *dfsBasicAccumulator) OnMessage(msg types.Message) (interface{}, error)
 	return types.MultiMessage{Values: requests}, nil
 }
 
+// Marks the requested, final and canonical URLs so links to any of them are
+// not followed again
 func (s *dfsBasicAccumulator) markVisited(composite message.CompositeAnalysis) {
-	if err := s.visitedUrls.SetBytes([]byte(composite.URI)); err != nil {
+	uris := [][]byte{[]byte(composite.URI)}
+
+	for _, uri := range []string{composite.FinalURI, composite.CanonicalURI()} {
+		if uri != "" && uri != composite.URI {
+			uris = append(uris, []byte(uri))
+		}
+	}
+
+	if err := s.visitedUrls.SetMany(uris); err != nil {
 		log.Errorf("failed to mark url as visited: %s", composite.URI)
 	}
 }
@@ -70,7 +105,7 @@ func (s *dfsBasicAccumulator) prepareRequests(composite message.CompositeAnalysi
 	var toVisit [][]byte
 	var source string
 
-	if meta, err := url.Parse(composite.URI); err == nil {
+	if meta, err := url.Parse(composite.BaseURI()); err == nil {
 		source = util.GetSLDAndTLD(meta.Host)
 	}
 
@@ -91,7 +126,7 @@ func (s *dfsBasicAccumulator) prepareRequests(composite message.CompositeAnalysi
 					RequestID: types.NewV4(),
 					URI:       u,
 					Host:      meta.Host,
-					Origin:    composite.URI,
+					Origin:    composite.BaseURI(),
 					Protocol:  types.ProtocolHTTP,
 					Depth:     composite.Depth + 1,
 				})
@@ -104,7 +139,7 @@ func (s *dfsBasicAccumulator) prepareRequests(composite message.CompositeAnalysi
 
 			req := message.FetcherRequest{
 				URI:    u,
-				Origin: composite.URI,
+				Origin: composite.BaseURI(),
 			}
 
 			if val, err := json.Marshal(req); err != nil {
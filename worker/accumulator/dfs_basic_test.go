@@ -140,3 +140,81 @@ func TestDfsBasicMaxDepthExceeded(t *testing.T) {
 	assert.True(t, ok)
 	assert.Len(t, mm.Values, 0)
 }
+
+func TestDfsBasicCanonicalDuplicate(t *testing.T) {
+	urlStorePath := util.NewTempPath("urlStore")
+	visitedUrlsPath := util.NewTempPath("visitedUrls")
+
+	defer os.Remove(visitedUrlsPath)
+	defer os.RemoveAll(urlStorePath)
+
+	accumulator := NewDfsBasicAccumulator(DfsBasicAccumulatorParams{
+		UrlStore: maps.NewMultiHostMap(maps.MultiHostMapParams{
+			BasePath: urlStorePath,
+		}),
+		VisitedUrls: bloom.NewRollingBloomFilter(bloom.RollingBloomFilterParams{
+			BloomCount: 3,
+			MaxN:       10000,
+			P:          1,
+			Path:       visitedUrlsPath,
+		}),
+		MaxDepth: 1,
+	})
+	newMessage := func(uri string) types.Message {
+		msg, _ := types.NewMessage(message.CompositeAnalysis{
+			FetcherResponse: message.FetcherResponse{
+				FetcherRequest: message.FetcherRequest{URI: uri},
+			},
+			Features: map[string]interface{}{
+				features.CanonicalField: features.Canonical("http://example.com/page"),
+				features.UrlField:       features.URIs{"http://example.com/1"},
+			},
+		}, types.CompositeAnalysisType)
+
+		return msg
+	}
+
+	out, err := accumulator.OnMessage(newMessage("http://example.com/page?ref=a"))
+
+	assert.NoError(t, err)
+	assert.Len(t, out.(types.MultiMessage).Values, 1)
+
+	// Same canonical page under another URL
+	out, err = accumulator.OnMessage(newMessage("http://example.com/page?ref=b"))
+
+	assert.NoError(t, err)
+	assert.Nil(t, out)
+}
+
+func TestDfsBasicNotModified(t *testing.T) {
+	urlStorePath := util.NewTempPath("urlStore")
+	visitedUrlsPath := util.NewTempPath("visitedUrls")
+
+	defer os.Remove(visitedUrlsPath)
+	defer os.RemoveAll(urlStorePath)
+
+	visitedUrls := bloom.NewRollingBloomFilter(bloom.RollingBloomFilterParams{
+		BloomCount: 3,
+		MaxN:       10000,
+		P:          1,
+		Path:       visitedUrlsPath,
+	})
+	accumulator := NewDfsBasicAccumulator(DfsBasicAccumulatorParams{
+		UrlStore:    maps.NewMultiHostMap(maps.MultiHostMapParams{BasePath: urlStorePath}),
+		VisitedUrls: visitedUrls,
+		MaxDepth:    1,
+	})
+	msg, _ := types.NewMessage(message.CompositeAnalysis{
+		FetcherResponse: message.FetcherResponse{
+			FetcherRequest: message.FetcherRequest{URI: "http://example.com"},
+			NotModified:    true,
+		},
+		Features: map[string]interface{}{},
+	}, types.CompositeAnalysisType)
+
+	out, err := accumulator.OnMessage(msg)
+
+	assert.NoError(t, err)
+	assert.Nil(t, out)
+	assert.True(t, visitedUrls.ContainsString("http://example.com"))
+}
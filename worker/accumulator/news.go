@@ -1,14 +1,13 @@
 package accumulator
 
 import (
-	"encoding/json"
 	"net/url"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/iakinsey/delver/codec"
 	"github.com/iakinsey/delver/frontier"
-	"github.com/iakinsey/delver/queue"
 	"github.com/iakinsey/delver/resource/bloom"
 	"github.com/iakinsey/delver/types"
 	"github.com/iakinsey/delver/types/features"
@@ -76,23 +75,33 @@ var blacklistedPaths = []string{
 }
 
 type newsAccumulator struct {
-	maxDepth  int
-	robots    frontier.Filter
-	newsQueue queue.Queue
-	seenUrls  bloom.BloomFilter
+	maxDepth int
+	robots   frontier.Filter
+	seenUrls bloom.BloomFilter
 }
 
 type NewsAccumulatorParams struct {
-	NewsQueue queue.Queue       `json:"-" resource:"news_queue"`
-	SeenUrls  bloom.BloomFilter `json:"-" resource:"seen_urls"`
+	SeenUrls bloom.BloomFilter `json:"-" resource:"seen_urls"`
+}
+
+func init() {
+	worker.Register("news_accumulator", worker.Factory{
+		Params: func() interface{} { return &NewsAccumulatorParams{} },
+		New: func(params interface{}) worker.Worker {
+			return NewNewsAccumulator(*params.(*NewsAccumulatorParams))
+		},
+		Accepts: []types.MessageType{types.CompositeAnalysisType},
+		// Articles are published as composite analyses, routed to wherever
+		// they are stored
+		Emits: []types.MessageType{types.FetcherRequestType, types.CompositeAnalysisType},
+	})
 }
 
 func NewNewsAccumulator(params NewsAccumulatorParams) worker.Worker {
 	return &newsAccumulator{
-		maxDepth:  maxDepth,
-		robots:    frontier.NewMemoryRobots(),
-		newsQueue: params.NewsQueue,
-		seenUrls:  params.SeenUrls,
+		maxDepth: maxDepth,
+		robots:   frontier.NewMemoryRobots(),
+		seenUrls: params.SeenUrls,
 	}
 }
 
@@ -100,7 +109,7 @@ func (s *newsAccumulator) OnMessage(msg types.Message) (interface{}, error) {
 	var URIs features.URIs
 	composite := message.CompositeAnalysis{}
 
-	if err := json.Unmarshal(msg.Message, &composite); err != nil {
+	if err := codec.Unmarshal(msg.Message, &composite); err != nil {
 		return nil, err
 	}
 
@@ -112,13 +121,14 @@ func (s *newsAccumulator) OnMessage(msg types.Message) (interface{}, error) {
 		return nil, nil
 	}
 
+	s.markSeen(composite)
+
 	urls := s.processUrls(composite, URIs)
-	s.processArticle(composite)
 
 	log.Printf("published %d requests for uri %s", len(urls), composite.URI)
 
 	return types.MultiMessage{
-		Values: urls,
+		Values: append(urls, s.processArticle(composite)...),
 	}, nil
 }
 
@@ -128,10 +138,10 @@ func (s *newsAccumulator) processUrls(composite message.CompositeAnalysis, URIs
 	}
 
 	var results []interface{}
-	originParsed, err := url.Parse(composite.URI)
+	originParsed, err := url.Parse(composite.BaseURI())
 
 	if err != nil {
-		log.Errorf("Unable to parse URI %s", composite.URI)
+		log.Errorf("Unable to parse URI %s", composite.BaseURI())
 		return nil
 	}
 
@@ -154,7 +164,7 @@ func (s *newsAccumulator) processUrls(composite message.CompositeAnalysis, URIs
 			RequestID: types.NewV4(),
 			URI:       u,
 			Host:      parsed.Host,
-			Origin:    composite.URI,
+			Origin:    composite.BaseURI(),
 			Protocol:  types.ProtocolHTTP,
 			Depth:     1,
 		})
@@ -167,27 +177,13 @@ func (s *newsAccumulator) processUrls(composite message.CompositeAnalysis, URIs
 	return results
 }
 
-func (s *newsAccumulator) processArticle(composite message.CompositeAnalysis) {
+// Pages linked from a seed are published as articles
+func (s *newsAccumulator) processArticle(composite message.CompositeAnalysis) []interface{} {
 	if composite.Depth == 0 {
-		return
-	}
-
-	msg, err := json.Marshal(composite)
-
-	if err != nil {
-		log.Errorf("failed to serialize message segment for URI: %s", composite.URI)
-		return
-	}
-
-	article := types.Message{
-		ID:          string(types.NewV4()),
-		MessageType: types.CompositeAnalysisType,
-		Message:     json.RawMessage(msg),
+		return nil
 	}
 
-	if err := s.newsQueue.Put(article, 0); err != nil {
-		log.Errorf("Failed to log article: %s", composite.URI)
-	}
+	return []interface{}{composite}
 }
 
 func (s *newsAccumulator) isValidFormat(composite message.CompositeAnalysis) bool {
@@ -248,6 +244,20 @@ func (s *newsAccumulator) urlAllowed(u *url.URL, origin string) bool {
 	return true
 }
 
+// Links to the page under its requested, final or canonical URL are not
+// followed again
+func (s *newsAccumulator) markSeen(composite message.CompositeAnalysis) {
+	for _, uri := range []string{composite.URI, composite.FinalURI, composite.CanonicalURI()} {
+		if uri == "" || s.seenUrls.ContainsString(uri) {
+			continue
+		}
+
+		if err := s.seenUrls.SetBytes([]byte(uri)); err != nil {
+			log.Errorf("failed to mark news URI as seen: %s", uri)
+		}
+	}
+}
+
 func (s *newsAccumulator) urlLooksLikeArticle(u *url.URL) bool {
 	var tokens []string
 
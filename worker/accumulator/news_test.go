@@ -9,21 +9,13 @@ import (
 	"github.com/iakinsey/delver/types"
 	"github.com/iakinsey/delver/types/features"
 	"github.com/iakinsey/delver/types/message"
-	"github.com/iakinsey/delver/util/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestNewsAccumulator(t *testing.T) {
-	paths := testutil.SetupWorkerQueueFolders("NewsAccumulatorTest")
-
-	defer testutil.TeardownWorkerQueueFolders(paths)
-
-	queues := testutil.CreateQueueTriad(paths)
-	newsQueue := queues.Outbox
 	accumulator := &newsAccumulator{
-		maxDepth:  maxDepth,
-		robots:    frontier.NewNullFilter(),
-		newsQueue: newsQueue,
+		maxDepth: maxDepth,
+		robots:   frontier.NewNullFilter(),
 		seenUrls: bloom.NewBloomFilter(bloom.BloomFilterParams{
 			MaxN: 1000,
 			P:    0.01,
@@ -46,7 +38,7 @@ func TestNewsAccumulator(t *testing.T) {
 	msg := types.Message{
 		ID:          "0-0-0-TestName",
 		MessageType: types.CompositeAnalysisType,
-		Message:     json.RawMessage(composite),
+		Message:     types.Payload(composite),
 	}
 
 	result, err := accumulator.OnMessage(msg)
@@ -62,3 +54,80 @@ func TestNewsAccumulator(t *testing.T) {
 		assert.IsType(t, message.FetcherRequest{}, value)
 	}
 }
+
+func TestNewsAccumulatorSkipsKnownPage(t *testing.T) {
+	accumulator := &newsAccumulator{
+		maxDepth: maxDepth,
+		robots:   frontier.NewNullFilter(),
+		seenUrls: bloom.NewBloomFilter(bloom.BloomFilterParams{
+			MaxN: 1000,
+			P:    0.01,
+		}),
+	}
+
+	composite, _ := json.Marshal(message.CompositeAnalysis{
+		FetcherResponse: message.FetcherResponse{
+			FetcherRequest: message.FetcherRequest{
+				URI: "http://test.com/article/this-is-a-test-article-today?ref=home",
+			},
+			FinalURI: "http://test.com/article/this-is-a-test-article-today/amp",
+		},
+		Features: map[string]interface{}{
+			features.CanonicalField: features.Canonical("http://test.com/article/this-is-a-test-article-today"),
+			features.UrlField: features.URIs{
+				"http://test.com/article/this-is-a-test-article-today",
+				"http://test.com/article/this-is-a-test-article-today/amp",
+				"http://test.com/article/another-test-article-from-today",
+			},
+		},
+	})
+
+	result, err := accumulator.OnMessage(types.Message{
+		MessageType: types.CompositeAnalysisType,
+		Message:     types.Payload(composite),
+	})
+
+	assert.NoError(t, err)
+
+	values := result.(types.MultiMessage).Values
+
+	assert.Len(t, values, 1)
+	assert.Equal(t, "http://test.com/article/another-test-article-from-today", values[0].(message.FetcherRequest).URI)
+}
+
+func TestNewsAccumulatorPublishesArticle(t *testing.T) {
+	accumulator := &newsAccumulator{
+		maxDepth: maxDepth,
+		robots:   frontier.NewNullFilter(),
+		seenUrls: bloom.NewBloomFilter(bloom.BloomFilterParams{
+			MaxN: 1000,
+			P:    0.01,
+		}),
+	}
+
+	composite, _ := json.Marshal(message.CompositeAnalysis{
+		FetcherResponse: message.FetcherResponse{
+			FetcherRequest: message.FetcherRequest{
+				URI:   "http://test.com/article/this-is-a-test-article-today",
+				Depth: 1,
+			},
+		},
+		Features: map[string]interface{}{
+			features.UrlField: features.URIs{},
+		},
+	})
+
+	result, err := accumulator.OnMessage(types.Message{
+		MessageType: types.CompositeAnalysisType,
+		Message:     types.Payload(composite),
+	})
+
+	assert.NoError(t, err)
+
+	values := result.(types.MultiMessage).Values
+
+	// Past the max depth no links are followed, the article is published
+	// for a route to take
+	assert.Len(t, values, 1)
+	assert.Equal(t, "http://test.com/article/this-is-a-test-article-today", values[0].(message.CompositeAnalysis).URI)
+}
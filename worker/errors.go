@@ -0,0 +1,91 @@
+package worker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Errors returned from OnMessage may be wrapped in one of these to tell the
+// manager how to handle the failed message. Unwrapped errors are retryable.
+
+// The message may succeed if processed again
+type RetryableError struct {
+	Err error
+}
+
+// The message will never succeed and is sent to the error outbox
+type PermanentError struct {
+	Err error
+}
+
+// The message should be processed again once the retry after has passed,
+// without counting towards max attempts
+type RateLimitedError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func NewRetryableError(err error) error {
+	return &RetryableError{Err: err}
+}
+
+func NewPermanentError(err error) error {
+	return &PermanentError{Err: err}
+}
+
+func NewRateLimitedError(err error, retryAfter time.Duration) error {
+	return &RateLimitedError{Err: err, RetryAfter: retryAfter}
+}
+
+func (e *RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryableError) Unwrap() error {
+	return e.Err
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RateLimitedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RateLimitedError) Unwrap() error {
+	return e.Err
+}
+
+// OnMessage panicked, the manager recovered and treats it as a failure
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+func IsPermanentError(err error) bool {
+	var permanent *PermanentError
+
+	return errors.As(err, &permanent)
+}
+
+// Returns the requested delay and true if the error is rate limited
+func GetRetryAfter(err error) (time.Duration, bool) {
+	var limited *RateLimitedError
+
+	if !errors.As(err, &limited) {
+		return 0, false
+	}
+
+	return limited.RetryAfter, true
+}
@@ -1,7 +1,6 @@
 package extractor
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"reflect"
@@ -9,6 +8,7 @@ import (
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/iakinsey/delver/codec"
 	"github.com/iakinsey/delver/extractors"
 	"github.com/iakinsey/delver/queue"
 	"github.com/iakinsey/delver/resource/objectstore"
@@ -38,6 +38,17 @@ type CompositeArgs struct {
 	TransformerQueue queue.Queue             `json:"-" resource:"transformer_queue"`
 }
 
+func init() {
+	worker.Register("composite_extractor", worker.Factory{
+		Params: func() interface{} { return &CompositeArgs{} },
+		New: func(params interface{}) worker.Worker {
+			return NewCompositeExtractorWorker(*params.(*CompositeArgs))
+		},
+		Accepts: []types.MessageType{types.FetcherResponseType},
+		Emits:   []types.MessageType{types.CompositeAnalysisType},
+	})
+}
+
 func NewCompositeExtractorWorker(opts CompositeArgs) worker.Worker {
 	return &compositeExtractor{
 		Enabled:          opts.Enabled,
@@ -168,10 +179,19 @@ func (s *compositeExtractor) OnMessage(msg types.Message) (interface{}, error) {
 	meta := message.FetcherResponse{}
 	var result interface{} = nil
 
-	if err := json.Unmarshal(msg.Message, &meta); err != nil {
+	if err := codec.Unmarshal(msg.Message, &meta); err != nil {
 		return nil, err
 	}
 
+	// There is no new content to extract or index, downstream workers still
+	// see the visit
+	if meta.NotModified {
+		return message.CompositeAnalysis{
+			FetcherResponse: meta,
+			Features:        make(map[string]interface{}),
+		}, nil
+	}
+
 	f, err := s.ObjectStore.Get(meta.StoreKey)
 
 	if err != nil {
@@ -205,7 +225,6 @@ func (s *compositeExtractor) OnMessage(msg types.Message) (interface{}, error) {
 	transformerErr := transformers.Send(
 		s.TransformerQueue,
 		string(composite.RequestID),
-		types.CompositeAnalysisType,
 		composite,
 	)
 
@@ -240,16 +259,23 @@ func (s *compositeExtractor) getExtractor(name string) extractors.Extractor {
 		return extractors.NewNgramExtractor()
 	case features.TitleField:
 		return extractors.NewTitleExtractor()
+	case features.CanonicalField:
+		return extractors.NewCanonicalExtractor()
 	default:
 		return nil
 	}
 }
 
+// The canonical extractor always runs, accumulators dedupe pages on it
 func (s *compositeExtractor) getExtractors() (result []extractors.Extractor) {
 	for _, name := range s.Enabled {
 		result = append(result, s.getExtractor(name))
 	}
 
+	if !util.StringInSlice(features.CanonicalField, s.Enabled) {
+		result = append(result, s.getExtractor(features.CanonicalField))
+	}
+
 	return
 }
 
@@ -258,7 +284,7 @@ func (s *compositeExtractor) sendToTransformerQueue(composite *message.Composite
 		return nil
 	}
 
-	b, err := json.Marshal(composite)
+	messageType, payload, err := types.EncodeMessage(composite)
 
 	if err != nil {
 		return errors.Wrap(err, "composite failed to serialize transformer message")
@@ -266,8 +292,8 @@ func (s *compositeExtractor) sendToTransformerQueue(composite *message.Composite
 
 	transformerMsg := types.Message{
 		ID:          string(composite.RequestID),
-		MessageType: types.CompositeAnalysisType,
-		Message:     json.RawMessage(b),
+		MessageType: messageType,
+		Message:     payload,
 	}
 
 	return errors.Wrap(
@@ -7,6 +7,7 @@ import (
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/iakinsey/delver/config"
 	"github.com/iakinsey/delver/types"
 	"github.com/iakinsey/delver/types/features"
 	"github.com/iakinsey/delver/types/message"
@@ -53,12 +54,17 @@ func TestCompositeExtractorUrlOnly(t *testing.T) {
 	queues.Inbox.Put(types.Message{
 		ID:          "0-0-0-TestName",
 		MessageType: types.FetcherResponseType,
-		Message:     json.RawMessage(message),
+		Message:     types.Payload(message),
 	}, 0)
 
 	testutil.AssertFolderSize(t, paths.Inbox, 1)
 
-	manager := worker.NewWorkerManager(extractor, queues.Inbox, queues.Outbox)
+	manager := worker.NewWorkerManager(worker.WorkerManagerParams{
+		Worker: extractor,
+		Inbox:  queues.Inbox,
+		Outbox: queues.Outbox,
+		Config: config.Worker{Count: 1},
+	})
 
 	queues.Inbox.Start()
 	go manager.Start()
@@ -0,0 +1,83 @@
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/iakinsey/delver/types/message"
+)
+
+// Checks the Content-Type header against the deny list and then the allow
+// list. Entries are media types such as text/html, or text/* for a whole
+// type. A missing content type only passes when there is no allow list.
+func checkContentType(header string, allowed, denied []string) error {
+	mediaType, _, err := mime.ParseMediaType(header)
+
+	if err != nil {
+		mediaType = ""
+	}
+
+	if mediaType != "" && matchesContentType(mediaType, denied) {
+		return fmt.Errorf("content type %s is denied", mediaType)
+	}
+
+	if len(allowed) > 0 && (mediaType == "" || !matchesContentType(mediaType, allowed)) {
+		return fmt.Errorf("content type %q is not allowed", mediaType)
+	}
+
+	return nil
+}
+
+func matchesContentType(mediaType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+
+		if pattern == mediaType {
+			return true
+		} else if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Ends a response body early once it passes the size limit or the transfer
+// deadline, recording why. A limit of 0 or less reads everything.
+type truncatingReader struct {
+	body   io.Reader
+	ctx    context.Context
+	limit  int64
+	read   int64
+	reason string
+}
+
+func (s *truncatingReader) Read(p []byte) (int, error) {
+	if s.limit > 0 && s.read >= s.limit {
+		// Anything left over means the body was cut short
+		var next [1]byte
+
+		if n, _ := s.body.Read(next[:]); n > 0 {
+			s.reason = message.TruncatedMaxBodySize
+		}
+
+		return 0, io.EOF
+	}
+
+	if s.limit > 0 && int64(len(p)) > s.limit-s.read {
+		p = p[:s.limit-s.read]
+	}
+
+	n, err := s.body.Read(p)
+	s.read += int64(n)
+
+	if err != nil && err != io.EOF && s.ctx.Err() == context.DeadlineExceeded {
+		s.reason = message.TruncatedTransferTimeout
+		return n, io.EOF
+	}
+
+	return n, err
+}
@@ -1,11 +1,20 @@
 package fetcher
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/iakinsey/delver/codec"
+	"github.com/iakinsey/delver/frontier"
+	"github.com/iakinsey/delver/resource/maps"
 	"github.com/iakinsey/delver/resource/objectstore"
 	"github.com/iakinsey/delver/types"
 	"github.com/iakinsey/delver/types/message"
@@ -16,50 +25,178 @@ import (
 
 // TODO put these values into a config module
 type HttpFetcherParams struct {
-	MaxRetries  int                     `json:"max_retries"`
-	ObjectStore objectstore.ObjectStore `json:"-" resource:"object_store"`
+	MaxRetries int `json:"max_retries"`
+	// Requests in flight to a single host across the fetcher, 0 for no limit
+	MaxHostConnections int `json:"max_host_connections"`
+	// Minimum time between requests to a single host
+	HostDelay time.Duration `json:"host_delay"`
+	// Raise the host delay to the robots.txt Crawl-delay, up to MaxHostDelay
+	RespectCrawlDelay bool                    `json:"respect_crawl_delay"`
+	MaxHostDelay      time.Duration           `json:"max_host_delay"`
+	ObjectStore       objectstore.ObjectStore `json:"-" resource:"object_store"`
+	// Validators of previous fetches by URL, every fetch is unconditional
+	// without one
+	ValidatorStore maps.Map `json:"-" resource:"validator_store,optional"`
+	// Bodies are cut short past this many bytes, 0 for no limit
+	MaxBodySize int64 `json:"max_body_size"`
+	// Media types such as text/html or text/*, checked before the body is
+	// read. The deny list wins and an empty allow list allows anything.
+	AllowedContentTypes []string `json:"allowed_content_types"`
+	DeniedContentTypes  []string `json:"denied_content_types"`
+	// Bodies are cut short once the whole transfer takes this long, 0 for no
+	// limit
+	TransferTimeout time.Duration `json:"transfer_timeout"`
+}
+
+// Stored per URL to make the next fetch of it conditional
+type fetchValidators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	ContentMD5   string `json:"content_md5,omitempty"`
 }
 
 type httpFetcher struct {
-	MaxRetries  int
-	ObjectStore objectstore.ObjectStore
-	Client      util.DelverHTTPClient
+	MaxRetries     int
+	ObjectStore    objectstore.ObjectStore
+	ValidatorStore maps.Map
+	Client         util.DelverHTTPClient
+	HostDelay      time.Duration
+	MaxHostDelay   time.Duration
+	MaxBodySize    int64
+	// Content type filters, see HttpFetcherParams
+	AllowedContentTypes []string
+	DeniedContentTypes  []string
+	TransferTimeout     time.Duration
+	// Requests are not scheduled per host when nil
+	Scheduler *hostScheduler
+	// Crawl-delay is ignored when nil
+	Robots frontier.Robots
+}
+
+func init() {
+	worker.Register("http_fetcher", worker.Factory{
+		Params: func() interface{} {
+			return &HttpFetcherParams{
+				MaxHostConnections: 2,
+				HostDelay:          time.Second,
+				RespectCrawlDelay:  true,
+				MaxHostDelay:       30 * time.Second,
+				MaxBodySize:        10 << 20,
+			}
+		},
+		New: func(params interface{}) worker.Worker {
+			return NewHttpFetcher(*params.(*HttpFetcherParams))
+		},
+		Accepts: []types.MessageType{types.FetcherRequestType},
+		Emits:   []types.MessageType{types.FetcherResponseType},
+	})
 }
 
 func NewHttpFetcher(args HttpFetcherParams) worker.Worker {
-	return &httpFetcher{
-		MaxRetries:  args.MaxRetries,
-		ObjectStore: args.ObjectStore,
-		Client:      util.NewHTTPClient(),
+	fetcher := &httpFetcher{
+		MaxRetries:          args.MaxRetries,
+		ObjectStore:         args.ObjectStore,
+		ValidatorStore:      args.ValidatorStore,
+		Client:              util.NewHTTPClient(),
+		HostDelay:           args.HostDelay,
+		MaxHostDelay:        args.MaxHostDelay,
+		Scheduler:           newHostScheduler(args.MaxHostConnections),
+		MaxBodySize:         args.MaxBodySize,
+		AllowedContentTypes: args.AllowedContentTypes,
+		DeniedContentTypes:  args.DeniedContentTypes,
+		TransferTimeout:     args.TransferTimeout,
 	}
+
+	if args.RespectCrawlDelay {
+		fetcher.Robots = frontier.NewMemoryRobots()
+	}
+
+	return fetcher
 }
 
 func (s *httpFetcher) OnMessage(msg types.Message) (interface{}, error) {
+	return s.OnMessageContext(context.Background(), msg)
+}
+
+// Cancelling the context aborts the request, including a body transfer in
+// progress, and fails the message instead of publishing a partial response
+func (s *httpFetcher) OnMessageContext(ctx context.Context, msg types.Message) (interface{}, error) {
 	request := message.FetcherRequest{}
 
-	if err := json.Unmarshal(msg.Message, &request); err != nil {
+	if err := codec.Unmarshal(msg.Message, &request); err != nil {
 		return nil, errors.Wrap(err, "error parsing fetcher request")
 	}
 
+	if host, ok := requestHost(request.URI); ok && s.Scheduler != nil {
+		// Queues may give a re-enqueued message a new ID, the request ID
+		// stays the same
+		if wait, ok := s.Scheduler.acquire(host, string(request.RequestID), s.hostDelay(request.URI)); !ok {
+			return nil, worker.NewRateLimitedError(fmt.Errorf("host %s is busy", host), wait)
+		}
+
+		defer s.Scheduler.release(host)
+	}
+
 	response := message.FetcherResponse{
 		FetcherRequest: request,
 	}
 
-	s.doHttpRequestWithRetry(request, &response)
+	s.doFetch(ctx, request, &response)
+
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrapf(err, "fetch of %s cancelled", request.URI)
+	}
 
 	return response, nil
 }
 
 func (s *httpFetcher) OnComplete() {}
 
-func (s *httpFetcher) doHttpRequestWithRetry(request message.FetcherRequest, response *message.FetcherResponse) {
+// Requests without a host are left to fail in the client
+func requestHost(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+
+	return u.Host, true
+}
+
+// The configured delay, or the host's Crawl-delay if longer
+func (s *httpFetcher) hostDelay(uri string) time.Duration {
+	if s.Robots == nil {
+		return s.HostDelay
+	}
+
+	crawlDelay, err := s.Robots.CrawlDelay(uri)
+
+	if err != nil {
+		log.Errorf("failed to get crawl delay for %s: %s", uri, err)
+		return s.HostDelay
+	}
+
+	if s.MaxHostDelay > 0 && crawlDelay > s.MaxHostDelay {
+		crawlDelay = s.MaxHostDelay
+	}
+
+	if crawlDelay > s.HostDelay {
+		return crawlDelay
+	}
+
+	return s.HostDelay
+}
+
+// Performs the request and records its outcome and timing in the response,
+// retrying is left to the client
+func (s *httpFetcher) doFetch(ctx context.Context, request message.FetcherRequest, response *message.FetcherResponse) {
 	var key types.UUID
 	var err error
 
 	start := time.Now()
 	response.Timestamp = start.Unix()
 
-	key, err = s.doHttpRequest(request, response)
+	key, err = s.doHttpRequest(ctx, request, response)
 
 	if err == nil {
 		response.StoreKey = key
@@ -73,8 +210,37 @@ func (s *httpFetcher) doHttpRequestWithRetry(request message.FetcherRequest, res
 	}
 }
 
-func (s *httpFetcher) doHttpRequest(request message.FetcherRequest, response *message.FetcherResponse) (key types.UUID, err error) {
-	res, err := s.Client.Perform(request.URI)
+func (s *httpFetcher) doHttpRequest(ctx context.Context, request message.FetcherRequest, response *message.FetcherResponse) (key types.UUID, err error) {
+	if s.TransferTimeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, s.TransferTimeout)
+		defer cancel()
+	}
+
+	req, err := newHTTPRequest(ctx, request)
+
+	if err != nil {
+		return key, err
+	}
+
+	// Only plain fetches are made conditional and remembered
+	conditional := req.Method == http.MethodGet && len(request.Headers) == 0
+	previous := fetchValidators{}
+
+	if conditional {
+		previous = s.loadValidators(request.URI)
+	}
+
+	if previous.ETag != "" {
+		req.Header.Set("If-None-Match", previous.ETag)
+	}
+
+	if previous.LastModified != "" {
+		req.Header.Set("If-Modified-Since", previous.LastModified)
+	}
+
+	res, err := s.Client.PerformRequest(req, request.Profile)
 
 	if err != nil {
 		return key, err
@@ -86,15 +252,142 @@ func (s *httpFetcher) doHttpRequest(request message.FetcherRequest, response *me
 
 	response.HTTPCode = res.StatusCode
 	response.Header = res.Header
+	response.Redirects, response.FinalURI = redirectChain(res)
+
+	log.Printf("%s %d %s", req.Method, response.HTTPCode, request.URI)
+
+	// Nothing is stored, the content is the same as last time
+	if res.StatusCode == http.StatusNotModified {
+		response.NotModified = true
+		response.ContentMD5 = previous.ContentMD5
+
+		return key, nil
+	}
+
+	if err := checkContentType(res.Header.Get("Content-Type"), s.AllowedContentTypes, s.DeniedContentTypes); err != nil {
+		return key, err
+	}
+
+	body := &truncatingReader{
+		body:  res.Body,
+		ctx:   ctx,
+		limit: s.MaxBodySize,
+	}
 	key = types.NewV4()
+	hash, err := s.ObjectStore.Put(key, body)
+
+	if err != nil {
+		return key, errors.Wrap(err, "store object failure")
+	}
+
+	response.ContentMD5 = hash
+	response.BodySize = body.read
+	response.Truncated = body.reason != ""
+	response.TruncatedReason = body.reason
+
+	if response.Truncated {
+		log.Warnf("truncated %s after %d bytes: %s", request.URI, body.read, body.reason)
+		return key, nil
+	}
+
+	response.ContentChanged = previous.ContentMD5 != "" && previous.ContentMD5 != hash
 
-	log.Printf("GET %d %s", response.HTTPCode, request.URI)
+	if conditional && res.StatusCode >= 200 && res.StatusCode < 300 {
+		s.saveValidators(request.URI, fetchValidators{
+			ETag:         res.Header.Get("ETag"),
+			LastModified: res.Header.Get("Last-Modified"),
+			ContentMD5:   hash,
+		})
+	}
+
+	return key, nil
+}
+
+// Walks back from the final request through the responses that redirected
+// to it
+func redirectChain(res *http.Response) (hops []message.Redirect, final string) {
+	if res.Request == nil {
+		return nil, ""
+	}
+
+	for req := res.Request; req.Response != nil && req.Response.Request != nil; req = req.Response.Request {
+		hops = append([]message.Redirect{{
+			URI:      req.Response.Request.URL.String(),
+			HTTPCode: req.Response.StatusCode,
+		}}, hops...)
+	}
+
+	return hops, res.Request.URL.String()
+}
+
+// Builds the request a fetcher request describes, without credentials which
+// the client adds from the named profile
+func newHTTPRequest(ctx context.Context, request message.FetcherRequest) (*http.Request, error) {
+	method := strings.ToUpper(request.Method)
+
+	if method == "" {
+		method = http.MethodGet
+	}
 
-	hash, err := s.ObjectStore.Put(key, res.Body)
+	var body io.Reader
+	contentType := ""
+
+	if request.Body != "" {
+		body = strings.NewReader(request.Body)
+	} else if len(request.Form) > 0 {
+		body = strings.NewReader(url.Values(request.Form).Encode())
+		contentType = "application/x-www-form-urlencoded"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, request.URI, body)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid fetcher request")
+	}
+
+	for key, values := range request.Headers {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
+	if contentType != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	return req, nil
+}
+
+func (s *httpFetcher) loadValidators(uri string) (v fetchValidators) {
+	if s.ValidatorStore == nil {
+		return
+	}
+
+	b, err := s.ValidatorStore.Get([]byte(uri))
+
+	if err == maps.ErrKeyNotFound {
+		return
+	} else if err != nil {
+		log.Errorf("failed to load validators for %s: %s", uri, err)
+	} else if err := json.Unmarshal(b, &v); err != nil {
+		log.Errorf("failed to parse validators for %s: %s", uri, err)
+	}
+
+	return
+}
+
+func (s *httpFetcher) saveValidators(uri string, v fetchValidators) {
+	if s.ValidatorStore == nil {
+		return
+	}
+
+	b, err := json.Marshal(v)
 
 	if err == nil {
-		response.ContentMD5 = hash
+		err = s.ValidatorStore.Set([]byte(uri), b)
 	}
 
-	return key, errors.Wrap(err, "store object failure")
+	if err != nil {
+		log.Errorf("failed to save validators for %s: %s", uri, err)
+	}
 }
@@ -1,16 +1,21 @@
 package fetcher
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/iakinsey/delver/resource/maps"
 	"github.com/iakinsey/delver/types"
 	"github.com/iakinsey/delver/types/message"
 	"github.com/iakinsey/delver/util"
 	"github.com/iakinsey/delver/util/testutil"
+	"github.com/iakinsey/delver/worker"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -38,7 +43,7 @@ func TestFetcher(t *testing.T) {
 	msg := types.Message{
 		ID:          "0-0-0-TestName",
 		MessageType: types.FetcherRequestType,
-		Message:     json.RawMessage(message),
+		Message:     types.Payload(message),
 	}
 
 	res, err := fetcher.OnMessage(msg)
@@ -47,3 +52,384 @@ func TestFetcher(t *testing.T) {
 	assert.NotNil(t, res)
 	testutil.AssertFolderSize(t, paths.ObjectStore, 1)
 }
+
+func TestFetcherPoliteness(t *testing.T) {
+	paths := testutil.SetupWorkerQueueFolders("HttpPolitenessTest")
+	queues := testutil.CreateQueueTriad(paths)
+	fetcher := &httpFetcher{
+		ObjectStore: queues.ObjectStore,
+		Client: &util.MockDelverHTTPClient{
+			Response: &http.Response{
+				Body:       io.NopCloser(strings.NewReader("test")),
+				StatusCode: 200,
+			},
+		},
+		HostDelay: time.Minute,
+		Scheduler: newHostScheduler(1),
+	}
+
+	fetch := func(uri string) error {
+		request, _ := json.Marshal(message.FetcherRequest{URI: uri})
+		_, err := fetcher.OnMessage(types.Message{
+			MessageType: types.FetcherRequestType,
+			Message:     request,
+		})
+
+		return err
+	}
+
+	assert.NoError(t, fetch("http://a.com/1"))
+	assert.NoError(t, fetch("http://b.com/1"))
+
+	// Deferred requests to the same host get consecutive slots
+	err := fetch("http://a.com/2")
+	retryAfter, ok := worker.GetRetryAfter(err)
+
+	assert.True(t, ok)
+	assert.InDelta(t, time.Minute, retryAfter, float64(time.Second))
+
+	retryAfter, ok = worker.GetRetryAfter(fetch("http://a.com/3"))
+
+	assert.True(t, ok)
+	assert.InDelta(t, 2*time.Minute, retryAfter, float64(time.Second))
+}
+
+// A deferred request comes back through the queue under a new message ID and
+// must still get the slot promised to it
+func TestFetcherDeferredThroughFileQueue(t *testing.T) {
+	paths := testutil.SetupWorkerQueueFolders("HttpDeferredTest")
+
+	defer testutil.TeardownWorkerQueueFolders(paths)
+
+	queues := testutil.CreateQueueTriad(paths)
+	now := time.Now()
+	scheduler := newHostScheduler(1)
+	scheduler.now = func() time.Time { return now }
+	fetcher := &httpFetcher{
+		ObjectStore: queues.ObjectStore,
+		Client: &util.MockDelverHTTPClient{
+			Response: &http.Response{
+				Body:       io.NopCloser(strings.NewReader("test")),
+				StatusCode: 200,
+			},
+		},
+		HostDelay: time.Minute,
+		Scheduler: scheduler,
+	}
+
+	newRequest := func(uri string) types.Message {
+		request, _ := json.Marshal(message.FetcherRequest{RequestID: types.NewV4(), URI: uri})
+
+		return types.Message{MessageType: types.FetcherRequestType, Message: request}
+	}
+
+	_, err := fetcher.OnMessage(newRequest("http://a.com/1"))
+	assert.NoError(t, err)
+
+	inbox := queues.Inbox
+	assert.NoError(t, inbox.Put(newRequest("http://a.com/2"), 0))
+	assert.NoError(t, inbox.Start())
+
+	defer inbox.Stop()
+
+	deferred := <-inbox.GetChannel()
+	_, err = fetcher.OnMessage(deferred)
+	wait, ok := worker.GetRetryAfter(err)
+
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, wait)
+	assert.NoError(t, inbox.PutAt(deferred, 0, time.Now()))
+	assert.NoError(t, inbox.EndTransaction(deferred, true))
+
+	now = now.Add(wait)
+
+	// A new arrival queues behind the promised slot
+	_, err = fetcher.OnMessage(newRequest("http://a.com/3"))
+	_, ok = worker.GetRetryAfter(err)
+	assert.True(t, ok)
+
+	retried := <-inbox.GetChannel()
+	assert.NotEqual(t, deferred.ID, retried.ID)
+
+	_, err = fetcher.OnMessage(retried)
+	assert.NoError(t, err)
+	assert.NoError(t, inbox.EndTransaction(retried, true))
+}
+
+func TestHostSchedulerConnections(t *testing.T) {
+	scheduler := newHostScheduler(2)
+
+	_, ok := scheduler.acquire("a.com", "", 0)
+	assert.True(t, ok)
+	_, ok = scheduler.acquire("a.com", "", 0)
+	assert.True(t, ok)
+
+	wait, ok := scheduler.acquire("a.com", "", 0)
+	assert.False(t, ok)
+	assert.Equal(t, busyHostRetryDelay, wait)
+
+	scheduler.release("a.com")
+
+	_, ok = scheduler.acquire("a.com", "", 0)
+	assert.True(t, ok)
+}
+
+func TestHostSchedulerReservationOrder(t *testing.T) {
+	now := time.Now()
+	scheduler := newHostScheduler(1)
+	scheduler.now = func() time.Time { return now }
+
+	_, ok := scheduler.acquire("a.com", "first", time.Second)
+	assert.True(t, ok)
+	scheduler.release("a.com")
+
+	// Waiters are promised consecutive slots in arrival order
+	for i, id := range []string{"b", "c", "d"} {
+		wait, ok := scheduler.acquire("a.com", id, time.Second)
+
+		assert.False(t, ok)
+		assert.Equal(t, time.Duration(i+1)*time.Second, wait)
+	}
+
+	now = now.Add(time.Second)
+
+	// A new arrival queues behind the waiters even though the host is free
+	wait, ok := scheduler.acquire("a.com", "e", time.Second)
+	assert.False(t, ok)
+	assert.Equal(t, 3*time.Second, wait)
+
+	// Coming back early keeps the promised slot
+	wait, ok = scheduler.acquire("a.com", "c", time.Second)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+
+	_, ok = scheduler.acquire("a.com", "b", time.Second)
+	assert.True(t, ok)
+	scheduler.release("a.com")
+
+	for _, id := range []string{"c", "d", "e"} {
+		now = now.Add(time.Second)
+
+		_, ok = scheduler.acquire("a.com", "late", time.Second)
+		assert.False(t, ok)
+
+		_, ok = scheduler.acquire("a.com", id, time.Second)
+		assert.True(t, ok)
+		scheduler.release("a.com")
+	}
+}
+
+func TestFetcherConditional(t *testing.T) {
+	paths := testutil.SetupWorkerQueueFolders("HttpConditionalTest")
+	queues := testutil.CreateQueueTriad(paths)
+	client := &util.MockDelverHTTPClient{}
+	fetcher := &httpFetcher{
+		ObjectStore:    queues.ObjectStore,
+		ValidatorStore: maps.NewPersistentMap(maps.PersistentMapParams{Path: util.MakeTempFolder("HttpValidators")}),
+		Client:         client,
+	}
+
+	fetch := func(code int, body string, header http.Header) message.FetcherResponse {
+		client.Response = &http.Response{
+			Body:       io.NopCloser(strings.NewReader(body)),
+			StatusCode: code,
+			Header:     header,
+		}
+
+		request, _ := json.Marshal(message.FetcherRequest{URI: "http://a.com"})
+		res, err := fetcher.OnMessage(types.Message{
+			MessageType: types.FetcherRequestType,
+			Message:     request,
+		})
+
+		assert.NoError(t, err)
+
+		return res.(message.FetcherResponse)
+	}
+
+	first := fetch(200, "first", http.Header{
+		"Etag":          {`"v1"`},
+		"Last-Modified": {"Mon, 01 Jan 2024 00:00:00 GMT"},
+	})
+
+	assert.False(t, first.NotModified)
+	assert.False(t, first.ContentChanged)
+	assert.Empty(t, client.Request.Header.Get("If-None-Match"))
+
+	second := fetch(304, "", http.Header{})
+
+	assert.Equal(t, `"v1"`, client.Request.Header.Get("If-None-Match"))
+	assert.Equal(t, "Mon, 01 Jan 2024 00:00:00 GMT", client.Request.Header.Get("If-Modified-Since"))
+	assert.True(t, second.NotModified)
+	assert.Empty(t, second.StoreKey)
+	assert.Equal(t, first.ContentMD5, second.ContentMD5)
+
+	third := fetch(200, "second", http.Header{})
+
+	assert.True(t, third.ContentChanged)
+	assert.NotEqual(t, first.ContentMD5, third.ContentMD5)
+}
+
+func TestFetcherBodyLimits(t *testing.T) {
+	paths := testutil.SetupWorkerQueueFolders("HttpLimitsTest")
+	queues := testutil.CreateQueueTriad(paths)
+	client := &util.MockDelverHTTPClient{}
+	fetcher := &httpFetcher{
+		ObjectStore:         queues.ObjectStore,
+		Client:              client,
+		MaxBodySize:         4,
+		AllowedContentTypes: []string{"text/*"},
+		DeniedContentTypes:  []string{"text/csv"},
+	}
+
+	fetch := func(contentType string) message.FetcherResponse {
+		client.Response = &http.Response{
+			Body:       io.NopCloser(strings.NewReader("test body")),
+			StatusCode: 200,
+			Header:     http.Header{"Content-Type": {contentType}},
+		}
+
+		request, _ := json.Marshal(message.FetcherRequest{URI: "http://a.com"})
+		res, err := fetcher.OnMessage(types.Message{
+			MessageType: types.FetcherRequestType,
+			Message:     request,
+		})
+
+		assert.NoError(t, err)
+
+		return res.(message.FetcherResponse)
+	}
+
+	res := fetch("text/html; charset=utf-8")
+
+	assert.True(t, res.Success)
+	assert.True(t, res.Truncated)
+	assert.Equal(t, message.TruncatedMaxBodySize, res.TruncatedReason)
+	assert.Equal(t, int64(4), res.BodySize)
+
+	for _, contentType := range []string{"text/csv", "application/pdf", ""} {
+		res = fetch(contentType)
+
+		assert.False(t, res.Success, contentType)
+		assert.Empty(t, res.StoreKey, contentType)
+	}
+
+	testutil.AssertFolderSize(t, paths.ObjectStore, 1)
+}
+
+func TestFetcherCustomRequest(t *testing.T) {
+	paths := testutil.SetupWorkerQueueFolders("HttpCustomTest")
+	queues := testutil.CreateQueueTriad(paths)
+	client := &util.MockDelverHTTPClient{
+		Response: &http.Response{
+			Body:       io.NopCloser(strings.NewReader("test")),
+			StatusCode: 200,
+		},
+	}
+	fetcher := &httpFetcher{
+		ObjectStore: queues.ObjectStore,
+		Client:      client,
+	}
+
+	request, _ := json.Marshal(message.FetcherRequest{
+		URI:     "http://a.com/login",
+		Method:  "post",
+		Headers: map[string][]string{"X-Test": {"1"}},
+		Form:    map[string][]string{"user": {"name"}},
+		Profile: "login",
+	})
+
+	_, err := fetcher.OnMessage(types.Message{
+		MessageType: types.FetcherRequestType,
+		Message:     request,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.MethodPost, client.Request.Method)
+	assert.Equal(t, "1", client.Request.Header.Get("X-Test"))
+	assert.Equal(t, "application/x-www-form-urlencoded", client.Request.Header.Get("Content-Type"))
+	assert.Equal(t, "login", client.Profile)
+
+	body, _ := io.ReadAll(client.Request.Body)
+
+	assert.Equal(t, "user=name", string(body))
+}
+
+func TestFetcherRedirects(t *testing.T) {
+	paths := testutil.SetupWorkerQueueFolders("HttpRedirectTest")
+	queues := testutil.CreateQueueTriad(paths)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/moved", http.StatusMovedPermanently)
+		case "/moved":
+			http.Redirect(w, r, "/new", http.StatusFound)
+		default:
+			w.Write([]byte("test"))
+		}
+	}))
+	defer server.Close()
+
+	fetcher := &httpFetcher{
+		ObjectStore: queues.ObjectStore,
+		Client:      util.NewHTTPClient(),
+	}
+
+	request, _ := json.Marshal(message.FetcherRequest{URI: server.URL + "/old"})
+	res, err := fetcher.OnMessage(types.Message{
+		MessageType: types.FetcherRequestType,
+		Message:     request,
+	})
+
+	assert.NoError(t, err)
+
+	response := res.(message.FetcherResponse)
+
+	assert.Equal(t, 200, response.HTTPCode)
+	assert.Equal(t, server.URL+"/new", response.FinalURI)
+	assert.Equal(t, []message.Redirect{
+		{URI: server.URL + "/old", HTTPCode: http.StatusMovedPermanently},
+		{URI: server.URL + "/moved", HTTPCode: http.StatusFound},
+	}, response.Redirects)
+}
+
+func TestFetcherCancelHungRequest(t *testing.T) {
+	paths := testutil.SetupWorkerQueueFolders("HttpCancelTest")
+	queues := testutil.CreateQueueTriad(paths)
+	cancelled := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- true
+		case <-time.After(time.Minute):
+		}
+	}))
+	defer server.Close()
+
+	var fetcher worker.Worker = &httpFetcher{
+		ObjectStore: queues.ObjectStore,
+		Client:      util.NewHTTPClient(),
+	}
+	contextWorker, ok := fetcher.(worker.ContextWorker)
+
+	assert.True(t, ok)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	request, _ := json.Marshal(message.FetcherRequest{URI: server.URL})
+	start := time.Now()
+	_, err := contextWorker.OnMessageContext(ctx, types.Message{
+		MessageType: types.FetcherRequestType,
+		Message:     request,
+	})
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	select {
+	case <-cancelled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("server never saw the request cancelled")
+	}
+}
@@ -0,0 +1,161 @@
+package fetcher
+
+import (
+	"sync"
+	"time"
+)
+
+// How long to defer a request to a host that is at its connection limit but
+// has no delay between requests
+const busyHostRetryDelay = time.Second
+
+// Idle hosts are forgotten at most this often
+const hostSweepInterval = time.Minute
+
+// Promised slots are kept this long past their start for the deferred
+// request to come back and take them
+const reservationGrace = time.Minute
+
+// Limits the requests in flight to each host and spaces out their start
+// times. Shared by every goroutine of a fetcher, requests that can not start
+// yet are told how long to wait instead of blocking.
+type hostScheduler struct {
+	maxConnections int
+	hosts          map[string]*hostState
+	lastSweep      time.Time
+	now            func() time.Time
+	lock           sync.Mutex
+}
+
+type hostState struct {
+	active int
+	// Earliest start of the next request
+	next time.Time
+	// End of the slots already promised to deferred requests
+	reserved time.Time
+	// Start of the slot promised to each deferred request
+	reservations map[string]time.Time
+}
+
+func newHostScheduler(maxConnections int) *hostScheduler {
+	return &hostScheduler{
+		maxConnections: maxConnections,
+		hosts:          make(map[string]*hostState),
+		lastSweep:      time.Now(),
+		now:            time.Now,
+	}
+}
+
+// Claims a connection to the host for the request with the given ID, which
+// must stay the same when the request is deferred and comes back. The
+// connection must be released once the request completes. Returns false and
+// how long to wait if the host is busy. Deferred requests are promised
+// consecutive slots in the order they arrive and new requests queue behind
+// them, so a request coming back for its slot is not overtaken. Requests
+// without an ID are spaced out the same way but their slots are not held for
+// them.
+func (s *hostScheduler) acquire(host, id string, delay time.Duration) (time.Duration, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	h, ok := s.hosts[host]
+
+	if !ok {
+		h = &hostState{reservations: make(map[string]time.Time)}
+		s.hosts[host] = h
+	}
+
+	h.expireReservations(now)
+
+	step := delay
+
+	if step <= 0 {
+		step = busyHostRetryDelay
+	}
+
+	busy := s.maxConnections > 0 && h.active >= s.maxConnections
+	ready := !busy && !now.Before(h.next)
+
+	if at, promised := h.reservations[id]; promised {
+		if now.Before(at) {
+			return at.Sub(now), false
+		} else if !ready {
+			// Still first in line once the host frees up
+			at = h.next
+
+			if !at.After(now) {
+				at = now.Add(step)
+			}
+
+			h.reservations[id] = at
+
+			return at.Sub(now), false
+		}
+
+		delete(h.reservations, id)
+	} else if !ready || len(h.reservations) > 0 {
+		at := now
+
+		if h.next.After(at) {
+			at = h.next
+		}
+
+		if h.reserved.After(at) {
+			at = h.reserved
+		}
+
+		if at.Equal(now) {
+			at = now.Add(step)
+		}
+
+		h.reserved = at.Add(step)
+
+		if id != "" {
+			h.reservations[id] = at
+		}
+
+		return at.Sub(now), false
+	}
+
+	h.active++
+	h.next = now.Add(delay)
+
+	return 0, true
+}
+
+// Drops promises to requests that never came back, so they stop holding up
+// the requests queued behind them
+func (s *hostState) expireReservations(now time.Time) {
+	for id, at := range s.reservations {
+		if now.Sub(at) > reservationGrace {
+			delete(s.reservations, id)
+		}
+	}
+}
+
+func (s *hostScheduler) release(host string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if h, ok := s.hosts[host]; ok && h.active > 0 {
+		h.active--
+	}
+}
+
+// Forgets hosts with nothing in flight or promised
+func (s *hostScheduler) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < hostSweepInterval {
+		return
+	}
+
+	s.lastSweep = now
+
+	for host, h := range s.hosts {
+		if h.active == 0 && len(h.reservations) == 0 && now.After(h.next) && now.After(h.reserved) {
+			delete(s.hosts, host)
+		}
+	}
+}
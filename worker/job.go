@@ -1,38 +1,59 @@
 package worker
 
 import (
+	"sync"
 	"time"
 
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iakinsey/delver/config"
 	"github.com/iakinsey/delver/queue"
 )
 
 type jobManager struct {
-	worker  Worker
-	timer   queue.Queue
-	outbox  queue.Queue
-	delay   time.Duration
-	manager WorkerManager
+	worker    Worker
+	timer     queue.Queue
+	outbox    queue.Queue
+	manager   WorkerManager
+	drainOnce sync.Once
 }
 
-func NewJobManager(worker Worker, outbox queue.Queue, delay time.Duration) WorkerManager {
-	timer := queue.NewTimerQueue(queue.TimerQueueParams{Delay: delay})
-	manager := NewWorkerManager(worker, timer, outbox)
+func NewJobManager(name string, worker Worker, outbox queue.Queue, routes []Route, schedule queue.TimerQueueParams) WorkerManager {
+	timer := queue.NewTimerQueue(schedule)
+	manager := NewWorkerManager(WorkerManagerParams{
+		Name:   name,
+		Worker: worker,
+		Inbox:  timer,
+		Outbox: outbox,
+		Routes: routes,
+		Config: config.Worker{Count: 1},
+	})
 
 	return &jobManager{
 		worker:  worker,
 		timer:   timer,
 		outbox:  outbox,
-		delay:   delay,
 		manager: manager,
 	}
 }
 
 func (s *jobManager) Start() {
+	if err := s.timer.Prepare(); err != nil {
+		log.Errorf("failed to prepare job timer: %s", err)
+	}
+
 	s.timer.Start()
 	s.manager.Start()
 }
 
+func (s *jobManager) Drain(grace time.Duration) {
+	s.drainOnce.Do(func() {
+		s.timer.Stop()
+		s.manager.Drain(grace)
+	})
+}
+
 func (s *jobManager) Stop() {
-	s.timer.Stop()
+	s.Drain(0)
 	s.manager.Stop()
 }
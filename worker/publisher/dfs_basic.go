@@ -38,6 +38,15 @@ type DfsBasicPublisherParams struct {
 	RotateAfter  time.Duration `json:"rotate_after"`
 }
 
+func init() {
+	worker.Register("dfs_basic_publisher", worker.Factory{
+		Params: func() interface{} { return &DfsBasicPublisherParams{} },
+		New: func(params interface{}) worker.Worker {
+			return NewDfsBasicPublisher(*params.(*DfsBasicPublisherParams))
+		},
+	})
+}
+
 func NewDfsBasicPublisher(params DfsBasicPublisherParams) worker.Worker {
 	return &dfsBasicPublisher{
 		outputQueue:  params.OutputQueue,
@@ -155,17 +164,17 @@ func (s *dfsBasicPublisher) publishUrls(host string, hostDbPath string) (int, er
 		req.Host = meta.Host
 		req.Protocol = types.ProtocolHTTP
 		req.Depth = 0
-		reqPayload, err := json.Marshal(req)
+		messageType, payload, err := types.EncodeMessage(req)
 
 		if err != nil {
-			log.Errorf("unable to serialize request to JSON for url: %s", req.URI)
+			log.Errorf("unable to serialize request for url: %s", req.URI)
 			return nil
 		}
 
 		msg := types.Message{
 			ID:          string(req.RequestID),
-			MessageType: types.FetcherRequestType,
-			Message:     json.RawMessage(reqPayload),
+			MessageType: messageType,
+			Message:     payload,
 		}
 
 		if err = s.outputQueue.Put(msg, 0); err != nil {
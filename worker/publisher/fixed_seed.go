@@ -17,6 +17,16 @@ type FixedSeedPublisherParams struct {
 	Uris []string `json:"uris"`
 }
 
+func init() {
+	worker.Register("fixed_seed_publisher", worker.Factory{
+		Params: func() interface{} { return &FixedSeedPublisherParams{} },
+		New: func(params interface{}) worker.Worker {
+			return NewFixedSeedPublisher(*params.(*FixedSeedPublisherParams))
+		},
+		Emits: []types.MessageType{types.FetcherRequestType},
+	})
+}
+
 func NewFixedSeedPublisher(params FixedSeedPublisherParams) worker.Worker {
 	return &fixedSeedPublisher{
 		uris: params.Uris,
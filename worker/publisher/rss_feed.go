@@ -21,6 +21,16 @@ type RssFeedPublisherParams struct {
 	Uris []string `json:"uris"`
 }
 
+func init() {
+	worker.Register("rss_feed_publisher", worker.Factory{
+		Params: func() interface{} { return &RssFeedPublisherParams{} },
+		New: func(params interface{}) worker.Worker {
+			return NewRssFeedPublisher(*params.(*RssFeedPublisherParams))
+		},
+		Emits: []types.MessageType{types.FetcherRequestType},
+	})
+}
+
 func NewRssFeedPublisher(params RssFeedPublisherParams) worker.Worker {
 	return &rssFeedPublisher{
 		uris:   params.Uris,
@@ -0,0 +1,71 @@
+package worker
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iakinsey/delver/types"
+)
+
+// Creates a worker type by name. Params returns a pointer to the parameters
+// with their defaults set. They are decoded from the worker config, fields
+// tagged `resource` are set to the named resources and the result is handed
+// to New.
+type Factory struct {
+	Params func() interface{}
+	New    func(params interface{}) Worker
+	// Message types read from the inbox and published to outboxes, used to
+	// validate configs. Accepting none means accepting any.
+	Accepts []types.MessageType
+	Emits   []types.MessageType
+}
+
+var factories = struct {
+	sync.RWMutex
+	m map[string]Factory
+}{m: make(map[string]Factory)}
+
+// Makes a worker type available to configs. Packages register their workers
+// from init, so downstream programs only need to import them.
+func Register(name string, factory Factory) {
+	factories.Lock()
+	defer factories.Unlock()
+
+	if _, ok := factories.m[name]; ok {
+		log.Fatalf("worker type %s registered twice", name)
+	}
+
+	factories.m[name] = factory
+}
+
+func GetFactory(name string) (Factory, error) {
+	factories.RLock()
+	defer factories.RUnlock()
+
+	factory, ok := factories.m[name]
+
+	if !ok {
+		return Factory{}, fmt.Errorf("unknown worker type %s", name)
+	}
+
+	return factory, nil
+}
+
+// Registered worker type names, sorted
+func Types() []string {
+	factories.RLock()
+	defer factories.RUnlock()
+
+	var names []string
+
+	for name := range factories.m {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
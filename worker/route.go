@@ -0,0 +1,150 @@
+package worker
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/queue"
+	"github.com/iakinsey/delver/types"
+)
+
+var routeClauseRegex = regexp.MustCompile(`^\s*([\w.]+)\s*(==|!=|=~|!~)\s*(.+?)\s*$`)
+
+// Sends published messages that match to an outbox. A zero message type
+// matches every type and a nil expression matches every message.
+type Route struct {
+	messageType types.MessageType
+	expression  *routeExpression
+	outbox      queue.Queue
+}
+
+// Clauses joined with &&, each comparing a dotted path into the message
+// against a literal, e.g. `host == "example.com" && language =~ "^en"`
+type routeExpression struct {
+	clauses []routeClause
+}
+
+type routeClause struct {
+	path     []string
+	operator string
+	value    string
+	regex    *regexp.Regexp
+}
+
+func NewRoute(conf config.Route, outbox queue.Queue) (Route, error) {
+	route := Route{outbox: outbox}
+
+	if conf.MessageType != "" {
+		messageType, err := types.ParseMessageType(conf.MessageType)
+
+		if err != nil {
+			return route, err
+		}
+
+		route.messageType = messageType
+	}
+
+	if conf.Match != "" {
+		expression, err := parseRouteExpression(conf.Match)
+
+		if err != nil {
+			return route, err
+		}
+
+		route.expression = expression
+	}
+
+	return route, nil
+}
+
+func (s Route) MatchesType(messageType types.MessageType) bool {
+	return s.messageType == types.NullMessage || s.messageType == messageType
+}
+
+// Document is the message decoded into generic JSON values
+func (s Route) matchesDocument(document interface{}) bool {
+	return s.expression == nil || s.expression.match(document)
+}
+
+func parseRouteExpression(expr string) (*routeExpression, error) {
+	expression := &routeExpression{}
+
+	for _, part := range strings.Split(expr, "&&") {
+		groups := routeClauseRegex.FindStringSubmatch(part)
+
+		if groups == nil {
+			return nil, fmt.Errorf("invalid route clause %q", strings.TrimSpace(part))
+		}
+
+		clause := routeClause{
+			path:     strings.Split(groups[1], "."),
+			operator: groups[2],
+			value:    groups[3],
+		}
+
+		if unquoted, err := strconv.Unquote(clause.value); err == nil {
+			clause.value = unquoted
+		}
+
+		if clause.operator == "=~" || clause.operator == "!~" {
+			regex, err := regexp.Compile(clause.value)
+
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid route pattern %q", clause.value)
+			}
+
+			clause.regex = regex
+		}
+
+		expression.clauses = append(expression.clauses, clause)
+	}
+
+	return expression, nil
+}
+
+func (s *routeExpression) match(document interface{}) bool {
+	for _, clause := range s.clauses {
+		if !clause.match(document) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Missing fields compare as the empty string
+func (s routeClause) match(document interface{}) bool {
+	value := ""
+	current := document
+
+	for _, key := range s.path {
+		object, ok := current.(map[string]interface{})
+
+		if !ok {
+			current = nil
+			break
+		}
+
+		current = object[key]
+	}
+
+	if current != nil {
+		value = fmt.Sprint(current)
+	}
+
+	switch s.operator {
+	case "==":
+		return value == s.value
+	case "!=":
+		return value != s.value
+	case "=~":
+		return s.regex.MatchString(value)
+	default:
+		return !s.regex.MatchString(value)
+	}
+}
@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/types"
+	"github.com/iakinsey/delver/types/message"
+)
+
+func TestWorkerManagerRoutes(t *testing.T) {
+	requests := &capturingQueue{}
+	english := &capturingQueue{}
+	fallback := &capturingQueue{}
+	routes := []Route{}
+
+	for _, rc := range []struct {
+		conf   config.Route
+		outbox *capturingQueue
+	}{
+		{config.Route{MessageType: "fetcher_request"}, requests},
+		{config.Route{MessageType: "composite_analysis", Match: `host == "example.com" && features.language =~ "^en"`}, english},
+	} {
+		route, err := NewRoute(rc.conf, rc.outbox)
+
+		assert.NoError(t, err)
+		routes = append(routes, route)
+	}
+
+	manager := NewWorkerManager(WorkerManagerParams{
+		Worker: &blockingWorker{},
+		Inbox:  &capturingQueue{},
+		Outbox: fallback,
+		Routes: routes,
+	}).(*workerManager)
+
+	analysis := func(host string, language string) message.CompositeAnalysis {
+		a := message.CompositeAnalysis{Features: map[string]interface{}{"language": language}}
+		a.Host = host
+		return a
+	}
+
+	manager.publishResponse(types.Message{}, types.MultiMessage{Values: []interface{}{
+		message.FetcherRequest{URI: "http://example.com"},
+		analysis("example.com", "en-US"),
+		analysis("example.com", "fr"),
+		analysis("example.org", "en"),
+	}})
+
+	assert.Len(t, requests.messages, 1)
+	assert.Len(t, english.messages, 1)
+	assert.Len(t, fallback.messages, 2)
+
+	for _, invalid := range []config.Route{
+		{MessageType: "unknown"},
+		{Match: "host"},
+		{Match: `host =~ "("`},
+	} {
+		_, err := NewRoute(invalid, nil)
+		assert.Error(t, err)
+	}
+}
@@ -20,6 +20,16 @@ type TransformerParams struct {
 	SearchAddresses []string `json:"search_addresses"`
 }
 
+func init() {
+	worker.Register("transformer", worker.Factory{
+		Params: func() interface{} { return &TransformerParams{} },
+		New: func(params interface{}) worker.Worker {
+			return NewTransformerWorker(*params.(*TransformerParams))
+		},
+		Accepts: []types.MessageType{types.CompositeAnalysisType, types.MetricType},
+	})
+}
+
 func NewTransformerWorker(opts TransformerParams) worker.Worker {
 	var t []transformers.Transformer
 
@@ -43,13 +53,24 @@ func NewTransformerWorker(opts TransformerParams) worker.Worker {
 func (s *transformer) OnMessage(msg types.Message) (interface{}, error) {
 	var tErr error
 	var entities []*types.Indexable
+	var value interface{}
 
 	for _, transformer := range s.t {
 		if transformer.Input() != msg.MessageType {
 			continue
 		}
 
-		idx, err := transformer.Perform(msg.Message)
+		if value == nil {
+			decoded, err := types.DecodeMessage(msg)
+
+			if err != nil {
+				return nil, worker.NewPermanentError(err)
+			}
+
+			value = decoded
+		}
+
+		idx, err := transformer.Perform(value)
 
 		if err != nil {
 			tErr = multierror.Append(tErr, err)
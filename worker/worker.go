@@ -1,6 +1,8 @@
 package worker
 
 import (
+	"context"
+
 	"github.com/iakinsey/delver/types"
 )
 
@@ -8,3 +10,11 @@ type Worker interface {
 	OnMessage(types.Message) (interface{}, error)
 	OnComplete()
 }
+
+// Implemented by workers that can stop early when their message times out or
+// the manager shuts down. The manager calls OnMessageContext instead of
+// OnMessage for these.
+type ContextWorker interface {
+	Worker
+	OnMessageContext(context.Context, types.Message) (interface{}, error)
+}
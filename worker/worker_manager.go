@@ -1,150 +1,692 @@
 package worker
 
 import (
-	"encoding/json"
+	"context"
+	"math"
+	"math/rand"
 	"reflect"
+	"runtime/debug"
 	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/armon/go-metrics"
+	"github.com/iakinsey/delver/codec"
+	"github.com/iakinsey/delver/config"
 	"github.com/iakinsey/delver/instrument"
 	"github.com/iakinsey/delver/queue"
 	"github.com/iakinsey/delver/types"
 	"github.com/iakinsey/delver/types/message"
 )
 
+const outboxFullDelay = 250 * time.Millisecond
+const poolScaleInterval = 5 * time.Second
+
+// Weight given to the newest sample in the moving average of durations
+const durationSmoothing = 0.2
+
 type WorkerManager interface {
+	// Runs the worker pool until drained
 	Start()
+	// Stops taking messages and waits for in-flight ones to finish, anything
+	// unfinished after the grace period is handed back to the inbox. Only the
+	// first call has an effect, a grace period of 0 waits indefinitely.
+	Drain(time.Duration)
+	// Drains without a deadline if needed, waits for any calls into the
+	// worker that a drain gave up on and completes the worker
 	Stop()
 }
+
 type workerManager struct {
-	inbox       queue.Queue
-	outbox      queue.Queue
-	priority    int
-	worker      Worker
-	terminating bool
-	terminate   chan bool
-	terminated  chan bool
-	metrics     metrics.MetricSink
-	workerName  string
-	termLock    sync.Mutex
-}
-
-func NewWorkerManager(worker Worker, inbox queue.Queue, outbox queue.Queue) WorkerManager {
+	inbox        queue.Queue
+	outbox       queue.Queue
+	routes       []Route
+	priority     int
+	worker       Worker
+	stopping     chan bool
+	drainOnce    sync.Once
+	running      sync.WaitGroup
+	inflight     map[uint64]types.Message
+	inflightSeq  uint64
+	inflightLock sync.Mutex
+	metrics      metrics.MetricSink
+	workerName   string
+	retry        config.RetryPolicy
+	errorOutbox  queue.Queue
+	timeout      time.Duration
+	// Cancelled when shutdown gives up on in-flight messages
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Calls into the worker, including ones abandoned by a timeout or drain
+	calls sync.WaitGroup
+	// Each pool goroutine stops when its channel is closed
+	pool          []chan bool
+	poolLock      sync.Mutex
+	minCount      int
+	maxCount      int
+	scaleInterval time.Duration
+	// Moving average of OnMessage durations in nanoseconds
+	duration     float64
+	durationLock sync.Mutex
+}
+
+type WorkerManagerParams struct {
+	// Configured worker name, metrics and lineage are recorded under it.
+	// Defaults to the name of the worker's type.
+	Name   string
+	Worker Worker
+	Inbox  queue.Queue
+	// Receives published messages that match no route
+	Outbox      queue.Queue
+	ErrorOutbox queue.Queue
+	Routes      []Route
+	Config      config.Worker
+}
+
+func NewWorkerManager(params WorkerManagerParams) WorkerManager {
+	conf := params.Config
+	minCount, maxCount := conf.MinCount, conf.MaxCount
+
+	if minCount <= 0 {
+		minCount = conf.Count
+	}
+
+	if minCount <= 0 {
+		minCount = 1
+	}
+
+	if maxCount < minCount {
+		maxCount = minCount
+	}
+
+	name := params.Name
+
+	if name == "" {
+		name = reflect.TypeOf(params.Worker).Elem().Name()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &workerManager{
-		inbox:       inbox,
-		outbox:      outbox,
-		priority:    0,
-		worker:      worker,
-		terminating: false,
-		terminate:   make(chan bool),
-		terminated:  make(chan bool),
-		metrics:     instrument.GetMetrics(),
-		workerName:  reflect.TypeOf(worker).Elem().Name(),
+		ctx:           ctx,
+		cancel:        cancel,
+		inbox:         params.Inbox,
+		outbox:        params.Outbox,
+		routes:        params.Routes,
+		priority:      0,
+		worker:        params.Worker,
+		stopping:      make(chan bool),
+		inflight:      make(map[uint64]types.Message),
+		metrics:       instrument.GetMetrics(),
+		workerName:    name,
+		retry:         conf.Retry,
+		errorOutbox:   params.ErrorOutbox,
+		timeout:       conf.Timeout,
+		minCount:      minCount,
+		maxCount:      maxCount,
+		scaleInterval: poolScaleInterval,
 	}
 }
 
 func (s *workerManager) Start() {
+	s.resize(s.minCount)
+
+	for {
+		select {
+		case <-time.After(s.scaleInterval):
+			if s.maxCount > s.minCount {
+				s.resize(s.desiredSize())
+			}
+		case <-s.stopping:
+			return
+		}
+	}
+}
+
+// Grows or shrinks the pool, goroutines asked to stop finish their current
+// message first
+func (s *workerManager) resize(size int) {
+	s.poolLock.Lock()
+	defer s.poolLock.Unlock()
+
+	select {
+	case <-s.stopping:
+		return
+	default:
+	}
+
+	for len(s.pool) < size {
+		quit := make(chan bool)
+		s.pool = append(s.pool, quit)
+		s.running.Add(1)
+
+		go s.run(quit)
+	}
+
+	for len(s.pool) > size {
+		close(s.pool[len(s.pool)-1])
+		s.pool = s.pool[:len(s.pool)-1]
+	}
+
+	s.metrics.SetGauge([]string{s.workerName, "pool", "size"}, float32(len(s.pool)))
+}
+
+// Sizes the pool to clear the inbox backlog within one scale interval,
+// shrinking by at most one goroutine at a time
+func (s *workerManager) desiredSize() int {
+	s.poolLock.Lock()
+	current := len(s.pool)
+	s.poolLock.Unlock()
+
+	backlog := s.inbox.Len()
+	duration := s.getDuration()
+	desired := current
+
+	if backlog < 0 {
+		return current
+	} else if backlog == 0 {
+		desired = current - 1
+	} else if duration <= 0 {
+		desired = current + 1
+	} else {
+		desired = int(math.Ceil(float64(backlog) * duration / float64(s.scaleInterval)))
+
+		if desired < current {
+			desired = current - 1
+		}
+	}
+
+	if desired < s.minCount {
+		desired = s.minCount
+	} else if desired > s.maxCount {
+		desired = s.maxCount
+	}
+
+	return desired
+}
+
+func (s *workerManager) recordDuration(d time.Duration) {
+	s.durationLock.Lock()
+	defer s.durationLock.Unlock()
+
+	if s.duration == 0 {
+		s.duration = float64(d)
+	} else {
+		s.duration = s.duration*(1-durationSmoothing) + float64(d)*durationSmoothing
+	}
+}
+
+func (s *workerManager) getDuration() float64 {
+	s.durationLock.Lock()
+	defer s.durationLock.Unlock()
+
+	return s.duration
+}
+
+func (s *workerManager) run(quit chan bool) {
+	defer s.running.Done()
+
 	for {
+		if !s.awaitOutbox(quit) {
+			return
+		}
+
 		select {
 		case message := <-s.inbox.GetChannel():
-			if s.isTerminating() {
+			seq, ok := s.track(message)
+
+			if !ok {
 				s.metrics.IncrCounter([]string{s.workerName, "terminated"}, 1)
-				s.terminated <- true
 				return
 			}
 
-			s.metrics.IncrCounter([]string{s.workerName, "message", "in"}, 1)
-			start := time.Now().UnixMilli()
-			result, err := s.worker.OnMessage(message)
-			end := time.Now().UnixMilli()
-			success := err == nil
+			s.process(message, seq)
+		case <-quit:
+			return
+		case <-s.stopping:
+			s.metrics.IncrCounter([]string{s.workerName, "terminated"}, 1)
+			return
+		}
+	}
+}
 
-			s.metrics.AddSample([]string{s.workerName, "duration", "millisecond"}, float32(end-start))
+func (s *workerManager) process(message types.Message, seq uint64) {
+	s.metrics.IncrCounter([]string{s.workerName, "message", "in"}, 1)
+	start := time.Now()
+	result, err := s.invoke(message)
+	elapsed := time.Since(start)
+	success := err == nil
 
-			if success {
-				s.metrics.IncrCounter([]string{s.workerName, "success"}, 1)
-				s.publishResponse(result)
-			} else {
-				s.metrics.IncrCounter([]string{s.workerName, "error"}, 1)
-				log.Errorf("Error occured while processing message: %s", err)
-			}
+	s.recordDuration(elapsed)
+	s.metrics.AddSample([]string{s.workerName, "duration", "millisecond"}, float32(elapsed.Milliseconds()))
 
-			if err := s.inbox.EndTransaction(message, err == nil); err != nil {
-				s.metrics.IncrCounter([]string{s.workerName, "inbox", "transaction", "error"}, 1)
-				log.Error(err)
-			} else {
-				s.metrics.IncrCounter([]string{s.workerName, "inbox", "transaction", "success"}, 1)
-			}
-		case <-s.terminate:
+	if !s.untrack(seq) {
+		// Outlived the shutdown grace period and was already returned to the inbox
+		s.metrics.IncrCounter([]string{s.workerName, "shutdown", "discarded"}, 1)
+		return
+	}
+
+	if success {
+		s.metrics.IncrCounter([]string{s.workerName, "success"}, 1)
+
+		if err := s.publishResponse(message, result); err != nil {
+			s.metrics.IncrCounter([]string{s.workerName, "publish", "error"}, 1)
+			log.Errorf("%s: failed to publish response: %s", s.workerName, err)
+			success = s.handleFailure(message, err)
+		}
+	} else {
+		s.metrics.IncrCounter([]string{s.workerName, "error"}, 1)
+		log.Errorf("Error occured while processing message: %s", err)
+		success = s.handleFailure(message, err)
+	}
+
+	if err := s.inbox.EndTransaction(message, success); err != nil {
+		s.metrics.IncrCounter([]string{s.workerName, "inbox", "transaction", "error"}, 1)
+		log.Error(err)
+	} else {
+		s.metrics.IncrCounter([]string{s.workerName, "inbox", "transaction", "success"}, 1)
+	}
+}
+
+// Runs OnMessage under the configured deadline. A worker that does not
+// implement ContextWorker keeps running after a timeout, but its result is
+// discarded and the pool goroutine moves on.
+func (s *workerManager) invoke(message types.Message) (interface{}, error) {
+	if s.timeout <= 0 {
+		return s.call(s.ctx, message)
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+	defer cancel()
+
+	type outcome struct {
+		result interface{}
+		err    error
+	}
+
+	done := make(chan outcome, 1)
+
+	go func() {
+		result, err := s.call(ctx, message)
+		done <- outcome{result, err}
+	}()
+
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-ctx.Done():
+		s.metrics.IncrCounter([]string{s.workerName, "timeout"}, 1)
+		return nil, NewRetryableError(errors.Wrapf(ctx.Err(), "message %s timed out after %s", message.ID, s.timeout))
+	}
+}
+
+// Calls the worker, turning a panic into a failed message
+func (s *workerManager) call(ctx context.Context, message types.Message) (result interface{}, err error) {
+	s.calls.Add(1)
+	defer s.calls.Done()
+
+	defer func() {
+		if r := recover(); r != nil {
+			s.metrics.IncrCounter([]string{s.workerName, "panic"}, 1)
+			panicErr := &PanicError{Value: r, Stack: debug.Stack()}
+			log.Errorf("%s: recovered from panic processing message %s: %v\n%s", s.workerName, message.ID, r, panicErr.Stack)
+			result, err = nil, panicErr
+		}
+	}()
+
+	if w, ok := s.worker.(ContextWorker); ok {
+		return w.OnMessageContext(ctx, message)
+	}
+
+	return s.worker.OnMessage(message)
+}
+
+// Holds off on consuming new messages while any outbox is at capacity
+func (s *workerManager) awaitOutbox(quit chan bool) bool {
+	for s.outboxFull() {
+		s.metrics.IncrCounter([]string{s.workerName, "outbox", "full"}, 1)
+
+		select {
+		case <-time.After(outboxFullDelay):
+		case <-quit:
+			return false
+		case <-s.stopping:
 			s.metrics.IncrCounter([]string{s.workerName, "terminated"}, 1)
-			s.terminated <- true
-			return
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *workerManager) outboxFull() bool {
+	if bounded, ok := s.outbox.(queue.BoundedQueue); ok && bounded.Full() {
+		return true
+	}
+
+	for _, route := range s.routes {
+		if bounded, ok := route.outbox.(queue.BoundedQueue); ok && bounded.Full() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Applies the retry policy to a failed message, true if the original can be
+// acknowledged because it was re-enqueued or given up on
+func (s *workerManager) handleFailure(message types.Message, err error) bool {
+	if IsPermanentError(err) {
+		s.metrics.IncrCounter([]string{s.workerName, "error", "permanent"}, 1)
+		return s.giveUp(message)
+	}
+
+	if retryAfter, ok := GetRetryAfter(err); ok {
+		s.metrics.IncrCounter([]string{s.workerName, "error", "rate_limited"}, 1)
+		return s.retryAt(message, retryAfter)
+	}
+
+	if s.retry.MaxAttempts <= 0 && s.retry.Backoff <= 0 {
+		return false
+	}
+
+	message.Attempts += 1
+
+	if s.retry.MaxAttempts > 0 && message.Attempts >= s.retry.MaxAttempts {
+		s.metrics.IncrCounter([]string{s.workerName, "error", "exhausted"}, 1)
+		return s.giveUp(message)
+	}
+
+	var delay time.Duration
+
+	if s.retry.Backoff > 0 {
+		delay = s.retry.Backoff << (message.Attempts - 1)
+
+		if delay <= 0 || (s.retry.MaxBackoff > 0 && delay > s.retry.MaxBackoff) {
+			delay = s.retry.MaxBackoff
 		}
 	}
+
+	return s.retryAt(message, delay)
+}
+
+// Re-enqueues a failed message after the delay plus jitter
+func (s *workerManager) retryAt(message types.Message, delay time.Duration) bool {
+	if s.retry.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(s.retry.Jitter)))
+	}
+
+	if err := s.inbox.PutAt(message, s.priority, time.Now().Add(delay)); err != nil {
+		s.metrics.IncrCounter([]string{s.workerName, "retry", "error"}, 1)
+		log.Errorf("%s: failed to schedule retry: %s", s.workerName, err.Error())
+		return false
+	}
+
+	s.metrics.IncrCounter([]string{s.workerName, "retry", "scheduled"}, 1)
+
+	return true
+}
+
+// Moves a message that will not be retried to the error outbox, or drops it
+// if there is none
+func (s *workerManager) giveUp(message types.Message) bool {
+	if s.errorOutbox == nil {
+		s.metrics.IncrCounter([]string{s.workerName, "error", "dropped"}, 1)
+		log.Errorf("%s: dropping failed message %s, no error outbox configured", s.workerName, message.ID)
+		return true
+	}
+
+	if err := s.errorOutbox.Put(message, s.priority); err != nil {
+		s.metrics.IncrCounter([]string{s.workerName, "error_outbox", "error"}, 1)
+		log.Errorf("%s: failed to publish to error outbox: %s", s.workerName, err.Error())
+		return false
+	}
+
+	return true
 }
 
+func (s *workerManager) Drain(grace time.Duration) {
+	s.drainOnce.Do(func() {
+		// Under the pool lock so no goroutine is added once draining begins
+		s.poolLock.Lock()
+		close(s.stopping)
+		s.poolLock.Unlock()
+
+		done := make(chan bool)
+
+		go func() {
+			s.running.Wait()
+			close(done)
+		}()
+
+		var deadline <-chan time.Time
+
+		if grace > 0 {
+			deadline = time.After(grace)
+		}
+
+		select {
+		case <-done:
+			return
+		case <-deadline:
+		}
+
+		s.cancel()
+
+		for _, message := range s.abandonInflight() {
+			s.metrics.IncrCounter([]string{s.workerName, "shutdown", "returned"}, 1)
+
+			if err := s.inbox.EndTransaction(message, false); err != nil {
+				log.Errorf("%s: failed to return message %s to inbox: %s", s.workerName, message.ID, err)
+			}
+		}
+	})
+}
+
+// Workers that do not take a context may still be processing messages handed
+// back by the drain, OnComplete waits for them so it does not release
+// resources they are using
 func (s *workerManager) Stop() {
-	defer s.worker.OnComplete()
+	s.Drain(0)
+	s.cancel()
 
-	s.setTerminating()
-	s.terminate <- true
-	<-s.terminated
+	// No call can start once the pool has exited
+	s.running.Wait()
+	s.calls.Wait()
+	s.worker.OnComplete()
 }
 
-func (s *workerManager) setTerminating() {
-	s.termLock.Lock()
-	defer s.termLock.Unlock()
+// Registers a message as in-flight, false if shutdown has started and the
+// message was handed back instead. Message IDs are not unique across every
+// queue, so in-flight messages are keyed by sequence.
+func (s *workerManager) track(message types.Message) (uint64, bool) {
+	s.inflightLock.Lock()
+	defer s.inflightLock.Unlock()
+
+	select {
+	case <-s.stopping:
+		if err := s.inbox.EndTransaction(message, false); err != nil {
+			log.Errorf("%s: failed to return message %s to inbox: %s", s.workerName, message.ID, err)
+		}
+
+		return 0, false
+	default:
+	}
+
+	s.inflightSeq += 1
+	s.inflight[s.inflightSeq] = message
+
+	return s.inflightSeq, true
+}
+
+// False if the message was abandoned during shutdown
+func (s *workerManager) untrack(seq uint64) bool {
+	s.inflightLock.Lock()
+	defer s.inflightLock.Unlock()
+
+	if _, ok := s.inflight[seq]; !ok {
+		return false
+	}
+
+	delete(s.inflight, seq)
 
-	s.terminating = true
+	return true
 }
 
-func (s *workerManager) isTerminating() bool {
-	s.termLock.Lock()
-	defer s.termLock.Unlock()
+func (s *workerManager) abandonInflight() (messages []types.Message) {
+	s.inflightLock.Lock()
+	defer s.inflightLock.Unlock()
+
+	for seq, message := range s.inflight {
+		messages = append(messages, message)
+		delete(s.inflight, seq)
+	}
 
-	return s.terminating
+	return
 }
 
-func (s *workerManager) publishResponse(result interface{}) {
+// Encodes every published value before sending any, so a value of an
+// unregistered type fails the inbound message rather than being dropped.
+// Encoding errors are permanent, a failed put such as a full outbox is
+// returned as is so the inbound message goes through the retry policy.
+func (s *workerManager) publishResponse(inbound types.Message, result interface{}) error {
 	if result == nil {
-		return
+		return nil
+	}
+
+	values := []interface{}{result}
+
+	if multi, ok := result.(types.MultiMessage); ok {
+		values = multi.Values
 	}
 
-	count := 1
-	switch d := result.(type) {
-	case types.MultiMessage:
-		for _, r := range d.Values {
-			count += 1
-			s.doPublish(r)
+	messages := make([]types.Message, 0, len(values))
+
+	for _, value := range values {
+		message, err := s.encode(inbound, value)
+
+		if err != nil {
+			return NewPermanentError(err)
 		}
-	default:
-		s.doPublish(result)
+
+		messages = append(messages, message)
 	}
 
-	s.metrics.IncrCounter([]string{s.workerName, "message", "out"}, float32(count))
+	for _, message := range messages {
+		if err := s.doPublish(message); err != nil {
+			return err
+		}
+	}
+
+	s.metrics.IncrCounter([]string{s.workerName, "message", "out"}, float32(len(messages)))
+
+	return nil
 }
 
-func (s *workerManager) doPublish(result interface{}) {
-	messageType, err := message.GetMessageTypeMapping(result)
+func (s *workerManager) encode(inbound types.Message, result interface{}) (types.Message, error) {
+	var userHeaders map[string]string
 
-	if err != nil {
-		log.Errorf("%s: unknown message type attempted to publish: %s", s.workerName, err.Error())
-		return
+	if headered, ok := result.(types.HeaderedMessage); ok {
+		result = headered.Value
+		userHeaders = headered.Headers
 	}
 
-	msg, err := json.Marshal(result)
+	messageType, payload, err := types.EncodeMessage(result)
 
 	if err != nil {
-		log.Errorf("%s: failed to serialize message segment: %s", s.workerName, err.Error())
-		return
+		return types.Message{}, err
+	}
+
+	return types.Message{
+		MessageType: messageType,
+		Message:     payload,
+		Headers:     s.getHeaders(inbound.Headers, result, userHeaders),
+	}, nil
+}
+
+func (s *workerManager) doPublish(message types.Message) error {
+	outboxes := s.route(message)
+
+	if len(outboxes) == 0 {
+		s.metrics.IncrCounter([]string{s.workerName, "outbox", "unrouted"}, 1)
+		log.Errorf("%s: no outbox for message of type %s", s.workerName, message.MessageType)
+		return nil
+	}
+
+	for _, outbox := range outboxes {
+		if err := outbox.Put(message, s.priority); err != nil {
+			s.metrics.IncrCounter([]string{s.workerName, "outbox", "error"}, 1)
+			return errors.Wrap(err, "failed to publish message")
+		}
 	}
 
-	message := types.Message{}
-	message.MessageType = messageType
-	message.Message = json.RawMessage(msg)
+	return nil
+}
+
+// Derives the headers of a published message from the message it was
+// produced in response to. Messages without a trace start a new one, taking
+// the seed from the request being published.
+func (s *workerManager) getHeaders(inbound types.Headers, result interface{}, user map[string]string) types.Headers {
+	headers := types.Headers{
+		TraceID:   inbound.TraceID,
+		Seed:      inbound.Seed,
+		CreatedAt: time.Now().UnixMilli(),
+		Hops:      inbound.Hops + 1,
+		Producer:  s.workerName,
+	}
+
+	if headers.TraceID == "" {
+		headers.TraceID = string(types.NewV4())
+	}
+
+	if request, ok := result.(message.FetcherRequest); ok && headers.Seed == "" {
+		headers.Seed = request.URI
+	}
+
+	if len(inbound.User) > 0 || len(user) > 0 {
+		headers.User = make(map[string]string)
+
+		for k, v := range inbound.User {
+			headers.User[k] = v
+		}
+
+		for k, v := range user {
+			headers.User[k] = v
+		}
+	}
+
+	return headers
+}
+
+// Returns the outbox of every matching route, or the default outbox
+func (s *workerManager) route(message types.Message) (outboxes []queue.Queue) {
+	var document interface{}
+	decoded := false
+
+	for _, route := range s.routes {
+		if !route.MatchesType(message.MessageType) {
+			continue
+		}
+
+		// Only decode when an expression needs it
+		if route.expression != nil && !decoded {
+			if err := codec.Unmarshal(message.Message, &document); err != nil {
+				log.Errorf("%s: failed to decode message for routing: %s", s.workerName, err)
+			}
+
+			decoded = true
+		}
+
+		if route.matchesDocument(document) {
+			outboxes = append(outboxes, route.outbox)
+		}
+	}
+
+	if len(outboxes) == 0 && s.outbox != nil {
+		outboxes = append(outboxes, s.outbox)
+	}
 
-	s.outbox.Put(message, s.priority)
+	return
 }
@@ -0,0 +1,345 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iakinsey/delver/config"
+	"github.com/iakinsey/delver/instrument"
+	"github.com/iakinsey/delver/queue"
+	"github.com/iakinsey/delver/types"
+	"github.com/iakinsey/delver/types/message"
+)
+
+type blockingWorker struct {
+	release   chan bool
+	completed bool
+}
+
+func (s *blockingWorker) OnMessage(types.Message) (interface{}, error) {
+	<-s.release
+
+	return nil, nil
+}
+
+func (s *blockingWorker) OnComplete() {
+	s.completed = true
+}
+
+type recordingQueue struct {
+	queue.Queue
+	results chan bool
+}
+
+func (s *recordingQueue) EndTransaction(msg types.Message, success bool) error {
+	s.results <- success
+
+	return nil
+}
+
+func TestWorkerManagerDrain(t *testing.T) {
+	w := &blockingWorker{release: make(chan bool)}
+	inbox := &recordingQueue{
+		Queue:   queue.NewChannelQueue(queue.ChannelQueueParams{Name: "TestWorkerManager"}),
+		results: make(chan bool, 2),
+	}
+	manager := NewWorkerManager(WorkerManagerParams{
+		Worker: w,
+		Inbox:  inbox,
+		Config: config.Worker{Count: 1},
+	})
+
+	assert.NoError(t, inbox.Start())
+	assert.NoError(t, inbox.Put(types.Message{ID: "0"}, 0))
+
+	go manager.Start()
+
+	// Wait for the message to be picked up
+	for inbox.Len() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The unfinished message is returned to the inbox once the grace period passes
+	manager.Drain(20 * time.Millisecond)
+
+	assert.False(t, <-inbox.results)
+
+	stopped := make(chan bool)
+
+	go func() {
+		manager.Stop()
+		close(stopped)
+	}()
+
+	// The worker is not completed while it is still processing
+	select {
+	case <-stopped:
+		t.Fatal("stopped while the worker was processing")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Its late result is discarded rather than acknowledged
+	close(w.release)
+	<-stopped
+
+	assert.True(t, w.completed)
+	assert.Len(t, inbox.results, 0)
+}
+
+type backlogQueue struct {
+	queue.Queue
+	backlog int64
+}
+
+func (s *backlogQueue) Len() int64 {
+	return s.backlog
+}
+
+func TestWorkerManagerPool(t *testing.T) {
+	w := &blockingWorker{release: make(chan bool)}
+	inbox := &backlogQueue{Queue: queue.NewChannelQueue(queue.ChannelQueueParams{Name: "TestWorkerManager"})}
+	manager := NewWorkerManager(WorkerManagerParams{
+		Worker: w,
+		Inbox:  inbox,
+		Config: config.Worker{MinCount: 1, MaxCount: 4},
+	}).(*workerManager)
+
+	manager.scaleInterval = time.Second
+	manager.resize(manager.minCount)
+	assert.Equal(t, 1, manager.desiredSize())
+
+	// Backlog with no duration samples yet grows the pool one at a time
+	inbox.backlog = 10
+	assert.Equal(t, 2, manager.desiredSize())
+
+	// 10 messages at 250ms each need 3 goroutines to clear in a second
+	manager.recordDuration(250 * time.Millisecond)
+	assert.Equal(t, 3, manager.desiredSize())
+
+	manager.recordDuration(time.Second)
+	assert.Equal(t, 4, manager.desiredSize())
+
+	manager.resize(4)
+	inbox.backlog = 0
+	assert.Equal(t, 3, manager.desiredSize())
+
+	manager.Drain(time.Second)
+	assert.Len(t, manager.pool, 4)
+
+	// Nothing grows after draining
+	manager.resize(5)
+	assert.Len(t, manager.pool, 4)
+}
+
+type capturingQueue struct {
+	queue.Queue
+	messages []types.Message
+	delays   []time.Duration
+}
+
+func (s *capturingQueue) Put(msg types.Message, priority int) error {
+	return s.PutAt(msg, priority, time.Now())
+}
+
+func (s *capturingQueue) PutAt(msg types.Message, priority int, notBefore time.Time) error {
+	s.messages = append(s.messages, msg)
+	s.delays = append(s.delays, time.Until(notBefore).Round(time.Second))
+
+	return nil
+}
+
+func TestWorkerManagerRetryPolicy(t *testing.T) {
+	inbox := &capturingQueue{}
+	errorOutbox := &capturingQueue{}
+	manager := NewWorkerManager(WorkerManagerParams{
+		Worker:      &blockingWorker{},
+		Inbox:       inbox,
+		ErrorOutbox: errorOutbox,
+		Config: config.Worker{
+			Retry: config.RetryPolicy{
+				MaxAttempts: 3,
+				Backoff:     time.Minute,
+			},
+		},
+	}).(*workerManager)
+	failure := errors.New("failure")
+	message := types.Message{ID: "0"}
+
+	assert.True(t, manager.handleFailure(message, failure))
+	assert.Equal(t, 1, inbox.messages[0].Attempts)
+	assert.Equal(t, time.Minute, inbox.delays[0])
+
+	assert.True(t, manager.handleFailure(inbox.messages[0], NewRetryableError(failure)))
+	assert.Equal(t, 2, inbox.messages[1].Attempts)
+	assert.Equal(t, 2*time.Minute, inbox.delays[1])
+
+	// Rate limits wait as requested without using up an attempt
+	assert.True(t, manager.handleFailure(inbox.messages[1], NewRateLimitedError(failure, time.Hour)))
+	assert.Equal(t, 2, inbox.messages[2].Attempts)
+	assert.Equal(t, time.Hour, inbox.delays[2])
+
+	assert.True(t, manager.handleFailure(inbox.messages[2], failure))
+	assert.Len(t, inbox.messages, 3)
+	assert.Len(t, errorOutbox.messages, 1)
+
+	assert.True(t, manager.handleFailure(message, NewPermanentError(failure)))
+	assert.Len(t, inbox.messages, 3)
+	assert.Len(t, errorOutbox.messages, 2)
+}
+
+type misbehavingWorker struct {
+	blockingWorker
+	panics bool
+}
+
+func (s *misbehavingWorker) OnMessageContext(ctx context.Context, msg types.Message) (interface{}, error) {
+	if s.panics {
+		panic("misbehaving")
+	}
+
+	<-ctx.Done()
+
+	return nil, ctx.Err()
+}
+
+func TestWorkerManagerTimeoutAndPanic(t *testing.T) {
+	params := WorkerManagerParams{
+		Worker: &misbehavingWorker{},
+		Inbox:  &capturingQueue{},
+		Config: config.Worker{Timeout: 10 * time.Millisecond},
+	}
+	manager := NewWorkerManager(params).(*workerManager)
+
+	_, err := manager.invoke(types.Message{ID: "0"})
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.False(t, IsPermanentError(err))
+
+	params.Worker = &misbehavingWorker{panics: true}
+	manager = NewWorkerManager(params).(*workerManager)
+	_, err = manager.invoke(types.Message{ID: "0"})
+
+	var panicErr *PanicError
+
+	assert.ErrorAs(t, err, &panicErr)
+	assert.Equal(t, "misbehaving", panicErr.Value)
+	assert.Contains(t, string(panicErr.Stack), "OnMessageContext")
+}
+
+// Two workers of the same type keep separate counters under their
+// configured names
+func TestWorkerManagerMetricsName(t *testing.T) {
+	w := &blockingWorker{release: make(chan bool, 1)}
+	inbox := &recordingQueue{results: make(chan bool, 1)}
+	manager := NewWorkerManager(WorkerManagerParams{
+		Name:   "named_worker",
+		Worker: w,
+		Inbox:  inbox,
+	}).(*workerManager)
+
+	named := instrument.GetCounters("named_worker")["success"]
+	typed := instrument.GetCounters("blockingWorker")["success"]
+
+	w.release <- true
+	seq, _ := manager.track(types.Message{ID: "0"})
+	manager.process(types.Message{ID: "0"}, seq)
+
+	assert.True(t, <-inbox.results)
+	assert.Equal(t, named+1, instrument.GetCounters("named_worker")["success"])
+	assert.Equal(t, typed, instrument.GetCounters("blockingWorker")["success"])
+}
+
+func TestWorkerManagerHeaders(t *testing.T) {
+	outbox := &capturingQueue{}
+	manager := NewWorkerManager(WorkerManagerParams{
+		Name:   "seed_fetcher",
+		Worker: &blockingWorker{},
+		Inbox:  &capturingQueue{},
+		Outbox: outbox,
+	}).(*workerManager)
+
+	manager.publishResponse(types.Message{}, message.FetcherRequest{URI: "http://example.com"})
+
+	root := outbox.messages[0].Headers
+
+	assert.NotEmpty(t, root.TraceID)
+	assert.Equal(t, "http://example.com", root.Seed)
+	assert.Equal(t, 1, root.Hops)
+	assert.Equal(t, "seed_fetcher", root.Producer)
+	assert.NotZero(t, root.CreatedAt)
+
+	manager.publishResponse(outbox.messages[0], types.WithHeaders(
+		message.FetcherRequest{URI: "http://example.com/child"},
+		map[string]string{"language": "en"},
+	))
+
+	child := outbox.messages[1].Headers
+
+	assert.Equal(t, root.TraceID, child.TraceID)
+	assert.Equal(t, root.Seed, child.Seed)
+	assert.Equal(t, 2, child.Hops)
+	assert.Equal(t, map[string]string{"language": "en"}, child.User)
+}
+
+func TestWorkerManagerUnknownMessageType(t *testing.T) {
+	outbox := &capturingQueue{}
+	manager := NewWorkerManager(WorkerManagerParams{
+		Worker: &blockingWorker{},
+		Inbox:  &capturingQueue{},
+		Outbox: outbox,
+	}).(*workerManager)
+
+	err := manager.publishResponse(types.Message{}, types.MultiMessage{Values: []interface{}{
+		message.FetcherRequest{URI: "http://example.com"},
+		struct{ URI string }{"http://example.com"},
+	}})
+
+	// Nothing is published when any value can not be
+	assert.True(t, errors.Is(err, types.ErrUnknownMessageType))
+	assert.Empty(t, outbox.messages)
+}
+
+func TestWorkerManagerPublishPointer(t *testing.T) {
+	outbox := &capturingQueue{}
+	manager := NewWorkerManager(WorkerManagerParams{
+		Worker: &blockingWorker{},
+		Inbox:  &capturingQueue{},
+		Outbox: outbox,
+	}).(*workerManager)
+
+	assert.NoError(t, manager.publishResponse(types.Message{}, &message.CompositeAnalysis{}))
+	assert.Equal(t, types.CompositeAnalysisType, outbox.messages[0].MessageType)
+}
+
+type fullQueue struct {
+	queue.Queue
+}
+
+func (s *fullQueue) Put(msg types.Message, priority int) error {
+	return queue.ErrQueueFull
+}
+
+func TestWorkerManagerOutboxFull(t *testing.T) {
+	inbox := &capturingQueue{}
+	manager := NewWorkerManager(WorkerManagerParams{
+		Worker: &blockingWorker{},
+		Inbox:  inbox,
+		Outbox: &fullQueue{},
+		Config: config.Worker{
+			Retry: config.RetryPolicy{MaxAttempts: 3},
+		},
+	}).(*workerManager)
+
+	err := manager.publishResponse(types.Message{}, message.FetcherRequest{URI: "http://example.com"})
+
+	assert.ErrorIs(t, err, queue.ErrQueueFull)
+	assert.False(t, IsPermanentError(err))
+
+	// The inbound message is retried rather than acknowledged as published
+	assert.True(t, manager.handleFailure(types.Message{ID: "0"}, err))
+	assert.Equal(t, 1, inbox.messages[0].Attempts)
+}